@@ -0,0 +1,57 @@
+package fgtrace
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// minAdaptiveHz is the lowest rate chosen by an adaptiveRate.
+	minAdaptiveHz = 1
+	// adaptiveCostWeight is the weight of the most recent sample in the moving
+	// average of the cost per sample.
+	adaptiveCostWeight = 0.2
+	// adaptiveHysteresis is the min relative difference between the current
+	// and the target rate for changing the rate, so it doesn't change on every
+	// tick.
+	adaptiveHysteresis = 0.1
+)
+
+// newAdaptiveRate returns an adaptiveRate that starts at maxHz.
+func newAdaptiveRate(budget float64, maxHz int) *adaptiveRate {
+	return &adaptiveRate{budget: budget, maxHz: maxHz, hz: maxHz}
+}
+
+// adaptiveRate chooses the sampling rate for Config.OverheadBudget.
+type adaptiveRate struct {
+	budget float64 // max fraction of wall time spent per sample
+	maxHz  int     // Config.Hz
+	hz     int     // current rate
+	cost   float64 // moving average of the seconds spent per sample
+}
+
+// update records that the last sample took cost to capture and encode and
+// returns the rate for the next samples as well as true if it has changed.
+// The rate is the highest one that keeps the average cost within the budget,
+// limited to minAdaptiveHz and maxHz.
+func (a *adaptiveRate) update(cost time.Duration) (int, bool) {
+	if a.cost == 0 {
+		a.cost = cost.Seconds()
+	} else {
+		a.cost = (1-adaptiveCostWeight)*a.cost + adaptiveCostWeight*cost.Seconds()
+	}
+
+	target := a.maxHz
+	if a.cost > 0 {
+		target = int(math.Min(a.budget/a.cost, float64(a.maxHz)))
+	}
+	if target < minAdaptiveHz {
+		target = minAdaptiveHz
+	}
+	diff := math.Abs(float64(target - a.hz))
+	if diff == 0 || (diff < adaptiveHysteresis*float64(a.hz) && target != a.maxHz && target != minAdaptiveHz) {
+		return a.hz, false
+	}
+	a.hz = target
+	return a.hz, true
+}
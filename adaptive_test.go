@@ -0,0 +1,31 @@
+package fgtrace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_adaptiveRate(t *testing.T) {
+	a := newAdaptiveRate(0.01, 100)
+
+	// 10ms per sample allows 1 Hz within a 1% budget.
+	hz, changed := a.update(10 * time.Millisecond)
+	require.True(t, changed)
+	require.Equal(t, 1, hz)
+
+	// The moving average recovers slowly and small changes are ignored.
+	hz, changed = a.update(5 * time.Millisecond)
+	require.False(t, changed)
+	require.Equal(t, 1, hz)
+	for i := 0; i < 40; i++ {
+		hz, _ = a.update(50 * time.Microsecond)
+	}
+	require.Equal(t, 100, hz)
+
+	// Free samples never exceed the configured rate.
+	hz, changed = a.update(0)
+	require.False(t, changed)
+	require.Equal(t, 100, hz)
+}
@@ -0,0 +1,302 @@
+package fgtrace
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Region starts a region with the given name on the calling goroutine and
+// returns a func that ends it, e.g.:
+//
+//	defer fgtrace.Region(ctx, "query")()
+//
+// The region is written with its exact begin and end to the annotation track
+// of the goroutine in all traces that are running when it ends, so it's
+// visible even if it's too short to be captured by the sampled stacks. A
+// region that started before a trace begins at the start of the trace. The
+// returned func must be called on the same goroutine, and the regions of a
+// goroutine must nest, i.e. a region has to end before the region it was
+// started in, since overlapping regions can't be displayed. If ctx belongs to
+// a task, see NewTask(), the region is labeled with it. Region is cheap when
+// no trace is running.
+func Region(ctx context.Context, name string) (end func()) {
+	start := traces.now()
+	return func() {
+		if !traces.active() {
+			return
+		}
+		traces.annotate(Annotation{
+			Kind:  RegionAnnotation,
+			G:     curGoroutineID(),
+			Name:  name,
+			Start: start,
+			End:   traces.now(),
+			Args:  taskArgs(ctx),
+		})
+	}
+}
+
+// Log writes an instant event named after key with the given value to the
+// annotation track of the calling goroutine in all traces that are running.
+// If ctx belongs to a task, see NewTask(), the event is labeled with it.
+func Log(ctx context.Context, key, value string) {
+	if !traces.active() {
+		return
+	}
+	args := taskArgs(ctx)
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	args["value"] = value
+	now := traces.now()
+	traces.annotate(Annotation{
+		Kind:  LogAnnotation,
+		G:     curGoroutineID(),
+		Name:  key,
+		Start: now,
+		End:   now,
+		Args:  args,
+	})
+}
+
+// NewTask starts a task with the given name and returns a context that belongs
+// to it as well as a func that ends it. A task groups the regions and log
+// events of an operation that may span several goroutines, e.g. a request. It
+// is written as a separate track in the process of the calling goroutine in
+// all traces that are running when it ends. Like for regions, a task that
+// started before a trace begins at the start of the trace.
+func NewTask(ctx context.Context, name string) (context.Context, func()) {
+	t := &task{
+		ID:    NewTaskID(),
+		Name:  name,
+		G:     curGoroutineID(),
+		Start: traces.now(),
+	}
+	end := func() {
+		if !traces.active() {
+			return
+		}
+		traces.annotate(Annotation{
+			Kind:  TaskAnnotation,
+			G:     t.G,
+			ID:    t.ID,
+			Name:  t.Name,
+			Start: t.Start,
+			End:   traces.now(),
+		})
+	}
+	return context.WithValue(ctx, taskKey{}, t), end
+}
+
+type taskKey struct{}
+
+// task is the context value of a task created by NewTask().
+type task struct {
+	ID    uint64
+	Name  string
+	G     int // id of the goroutine that created the task
+	Start time.Time
+}
+
+// taskArgs returns the args that label an annotation with the task of ctx, or
+// nil if ctx doesn't belong to a task.
+func taskArgs(ctx context.Context) map[string]interface{} {
+	t, ok := ctx.Value(taskKey{}).(*task)
+	if !ok {
+		return nil
+	}
+	return t.args()
+}
+
+// args returns the args that label an annotation with t.
+func (t *task) args() map[string]interface{} {
+	return TaskArgs(t.Name, t.ID)
+}
+
+// Annotation is a region, log event or task created by the user, or a GC cycle
+// of the runtime, see AnnotationSource.
+type Annotation struct {
+	Kind AnnotationKind
+	// G is the id of the annotated goroutine. It's ignored for GC cycles.
+	G int
+	// ID is the id of a task, see NewTaskID().
+	ID   uint64
+	Name string
+	// Start and End are equal for log events.
+	Start, End time.Time
+	// Args are added to the event, e.g. TaskArgs() to label it with a task.
+	Args map[string]interface{}
+}
+
+// AnnotationKind is the kind of an Annotation.
+type AnnotationKind int
+
+const (
+	// RegionAnnotation is a region of a goroutine with a begin and end, see
+	// Region().
+	RegionAnnotation AnnotationKind = iota
+	// LogAnnotation is an instant log event of a goroutine, see Log().
+	LogAnnotation
+	// TaskAnnotation is a task that groups regions and log events, see
+	// NewTask().
+	TaskAnnotation
+	// GCAnnotation is a GC cycle of the runtime, which is added to the "GC
+	// cycles" track of the "runtime" process.
+	GCAnnotation
+)
+
+// lastTaskID is the id of the last task created by NewTaskID().
+var lastTaskID uint64
+
+// NewTaskID returns a new task id that is unique within the process. It's
+// used by NewTask() and allows an AnnotationSource to assign ids to its tasks
+// that don't collide with them.
+func NewTaskID() uint64 {
+	return atomic.AddUint64(&lastTaskID, 1)
+}
+
+// TaskArgs returns the args that label an annotation with the task with the
+// given name and id.
+func TaskArgs(name string, id uint64) map[string]interface{} {
+	return map[string]interface{}{"task": name, "task_id": id}
+}
+
+// AnnotationSource provides annotations that were recorded outside of fgtrace,
+// see Config.ExecutionTrace.
+type AnnotationSource interface {
+	// ReadAnnotations calls annotate for every annotation of the source until
+	// it is exhausted and returns nil, or returns the first error.
+	ReadAnnotations(annotate func(Annotation)) error
+}
+
+// userEvent is an annotation with timestamps relative to the start of a trace.
+type userEvent struct {
+	Kind AnnotationKind
+	G    int
+	ID   uint64
+	Name string
+	Ts   float64 // microseconds since the start of the trace
+	Dur  float64 // microseconds
+	Args map[string]interface{}
+}
+
+// newUserEvent returns the user event for a in a trace that started at start.
+func newUserEvent(a Annotation, start time.Time) userEvent {
+	return userEvent{
+		Kind: a.Kind,
+		G:    a.G,
+		ID:   a.ID,
+		Name: a.Name,
+		Ts:   durationUs(a.Start.Sub(start)),
+		Dur:  durationUs(a.End.Sub(a.Start)),
+		Args: a.Args,
+	}
+}
+
+// traces holds the running traces that receive annotations.
+var traces = &traceSet{m: map[*Trace]struct{}{}}
+
+type traceSet struct {
+	n  int32 // len(m), read without holding mu
+	mu sync.Mutex
+	m  map[*Trace]struct{}
+}
+
+// active returns true if there is at least one running trace.
+func (s *traceSet) active() bool {
+	return atomic.LoadInt32(&s.n) > 0
+}
+
+func (s *traceSet) add(t *Trace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[t] = struct{}{}
+	atomic.StoreInt32(&s.n, int32(len(s.m)))
+}
+
+func (s *traceSet) remove(t *Trace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, t)
+	atomic.StoreInt32(&s.n, int32(len(s.m)))
+}
+
+// now returns the current time of the clock of a running trace, or time.Now()
+// if no trace is running. Traces only use a different clock in tests.
+func (s *traceSet) now() time.Time {
+	if !s.active() {
+		return time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t := range s.m {
+		return t.clock.Now()
+	}
+	return time.Now()
+}
+
+// annotate passes a to all running traces.
+func (s *traceSet) annotate(a Annotation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t := range s.m {
+		t.annotate(a)
+	}
+}
+
+// annotations buffers the user events of a trace until they are added to the
+// next sample.
+type annotations struct {
+	mu     sync.Mutex
+	events []userEvent
+}
+
+func (a *annotations) add(ev userEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, ev)
+}
+
+// take returns the buffered events and clears the buffer.
+func (a *annotations) take() []userEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events := a.events
+	a.events = nil
+	return events
+}
+
+// clip removes the events that begin after end and cuts off the ones that
+// last beyond it. Events imported from an execution trace may extend past the
+// end of the trace.
+func clip(events []userEvent, end float64) []userEvent {
+	clipped := events[:0]
+	for _, ev := range events {
+		if ev.Ts > end {
+			continue
+		} else if ev.Ts+ev.Dur > end {
+			ev.Dur = end - ev.Ts
+		}
+		clipped = append(clipped, ev)
+	}
+	return clipped
+}
+
+// curGoroutineID returns the id of the calling goroutine. The runtime doesn't
+// expose it, so it's parsed from the header of the goroutine's stack trace,
+// e.g. "goroutine 18 [running]:".
+func curGoroutineID() int {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.Atoi(string(b))
+	return id
+}
@@ -0,0 +1,229 @@
+package fgtrace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felixge/fgtrace/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func ExampleRegion() {
+	ctx, endTask := NewTask(context.Background(), "request")
+	defer endTask()
+
+	func() {
+		defer Region(ctx, "query")()
+		// <run query>
+	}()
+	Log(ctx, "rows", "42")
+}
+
+func TestRegion(t *testing.T) {
+	// No trace is running, so this is a no-op.
+	Region(context.Background(), "untraced")()
+
+	buf := &bytes.Buffer{}
+	trace := Config{Dst: Writer(buf), Hz: 100}.Trace()
+	ctx, endTask := NewTask(context.Background(), "request")
+	end := Region(ctx, "query")
+	time.Sleep(time.Millisecond)
+	end()
+	Log(ctx, "rows", "42")
+	Region(context.Background(), "render")()
+	endTask()
+	require.NoError(t, trace.Stop())
+	Region(context.Background(), "after stop")()
+
+	data, err := internal.Unmarshal(buf.Bytes())
+	require.NoError(t, err)
+	events := data.Filter(func(e *internal.Event) bool {
+		return e.Tid == internal.AnnotationTid && e.Ph != "M"
+	}).Events
+	require.Len(t, events, 5)
+
+	g := int64(curGoroutineID())
+	query, rows, render, begin, taskEnd := events[0], events[1], events[2], events[3], events[4]
+	taskArgs := map[string]interface{}{"task": "request", "task_id": float64(begin.ID)}
+	require.Equal(t, "query", query.Name)
+	require.Equal(t, "X", query.Ph)
+	require.Equal(t, g, query.Pid)
+	require.GreaterOrEqual(t, query.Dur, 1000.0)
+	require.Equal(t, taskArgs, query.Args)
+
+	require.Equal(t, "rows", rows.Name)
+	require.Equal(t, "i", rows.Ph)
+	require.Equal(t, g, rows.Pid)
+	require.GreaterOrEqual(t, rows.Ts, query.Ts+query.Dur)
+	taskArgs["value"] = "42"
+	require.Equal(t, taskArgs, rows.Args)
+
+	require.Equal(t, "render", render.Name)
+	require.Nil(t, render.Args)
+
+	require.Equal(t, "request", begin.Name)
+	require.Equal(t, "b", begin.Ph)
+	require.Equal(t, "e", taskEnd.Ph)
+	require.Equal(t, g, begin.Pid)
+	require.LessOrEqual(t, begin.Ts, query.Ts)
+	require.GreaterOrEqual(t, taskEnd.Ts, rows.Ts)
+
+	t.Run("started-before-trace", func(t *testing.T) {
+		end := Region(context.Background(), "early")
+		buf := &bytes.Buffer{}
+		trace := Config{Dst: Writer(buf), Hz: 100}.Trace()
+		end()
+		require.NoError(t, trace.Stop())
+
+		data, err := internal.Unmarshal(buf.Bytes())
+		require.NoError(t, err)
+		events := data.Filter(func(e *internal.Event) bool {
+			return e.Tid == internal.AnnotationTid && e.Ph != "M"
+		}).Events
+		require.Len(t, events, 1)
+		require.Equal(t, "early", events[0].Name)
+		require.Equal(t, 0.0, events[0].Ts)
+	})
+
+	t.Run("task-started-before-trace", func(t *testing.T) {
+		_, endTask := NewTask(context.Background(), "early")
+		buf := &bytes.Buffer{}
+		trace := Config{Dst: Writer(buf), Hz: 100}.Trace()
+		endTask()
+		require.NoError(t, trace.Stop())
+
+		data, err := internal.Unmarshal(buf.Bytes())
+		require.NoError(t, err)
+		events := data.Filter(func(e *internal.Event) bool {
+			return e.Tid == internal.AnnotationTid && e.Ph != "M"
+		}).Events
+		require.Len(t, events, 2)
+		require.Equal(t, "early", events[0].Name)
+		require.Equal(t, int64(curGoroutineID()), events[0].Pid)
+		require.Equal(t, 0.0, events[0].Ts)
+	})
+
+	t.Run("clock", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		clock := internal.NewFakeClock(time.Now())
+		conf := Config{
+			Dst:      Writer(buf),
+			Hz:       100,
+			Profiler: &scriptedProfiler{Script: [][]*Goroutine{{newTestGoroutine(1, "running", "main")}}},
+			clock:    clock,
+		}
+		trace := conf.Trace()
+		clock.Advance(time.Millisecond)
+		end := Region(context.Background(), "query")
+		clock.Advance(5 * time.Millisecond)
+		end()
+		Log(context.Background(), "rows", "42")
+		require.NoError(t, trace.Stop())
+
+		data, err := internal.Unmarshal(buf.Bytes())
+		require.NoError(t, err)
+		events := data.Filter(func(e *internal.Event) bool {
+			return e.Tid == internal.AnnotationTid && e.Ph != "M"
+		}).Events
+		require.Len(t, events, 2)
+		require.Equal(t, 1000.0, events[0].Ts)
+		require.Equal(t, 5000.0, events[0].Dur)
+		require.Equal(t, 6000.0, events[1].Ts)
+	})
+}
+
+func TestConfig_ExecutionTrace(t *testing.T) {
+	t.Run("annotations", func(t *testing.T) {
+		g := curGoroutineID()
+		buf := &bytes.Buffer{}
+		source := annotationFunc(func(annotate func(Annotation)) error {
+			now := time.Now()
+			annotate(Annotation{Kind: RegionAnnotation, G: g, Name: "before", Start: now.Add(-2 * time.Second), End: now.Add(-time.Second)})
+			annotate(Annotation{Kind: RegionAnnotation, G: g, Name: "step", Start: now, End: now.Add(time.Millisecond)})
+			return nil
+		})
+		trace := Config{Dst: Writer(buf), Hz: 100, ExecutionTrace: source}.Trace()
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, trace.Stop())
+
+		data, err := internal.Unmarshal(buf.Bytes())
+		require.NoError(t, err)
+		events := data.Filter(func(e *internal.Event) bool {
+			return e.Tid == internal.AnnotationTid && e.Ph != "M"
+		}).Events
+		require.Len(t, events, 1)
+		require.Equal(t, "step", events[0].Name)
+		require.Equal(t, int64(g), events[0].Pid)
+		require.Equal(t, 1000.0, events[0].Dur)
+	})
+
+	t.Run("gc", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		source := annotationFunc(func(annotate func(Annotation)) error {
+			now := time.Now()
+			annotate(Annotation{Kind: GCAnnotation, Name: "GC", Start: now, End: now.Add(time.Millisecond), Args: map[string]interface{}{"gc": 1}})
+			return nil
+		})
+		trace := Config{Dst: Writer(buf), Hz: 100, ExecutionTrace: source}.Trace()
+		time.Sleep(2 * time.Millisecond)
+		require.NoError(t, trace.Stop())
+
+		data, err := internal.Unmarshal(buf.Bytes())
+		require.NoError(t, err)
+		events := data.Filter(func(e *internal.Event) bool {
+			return e.Pid == internal.RuntimePid && e.Tid == int64(internal.GCCycleTrack)
+		}).Events
+		require.Len(t, events, 2)
+		require.Equal(t, "GC cycles", events[0].Args["name"])
+		require.Equal(t, "GC", events[1].Name)
+		require.Equal(t, 1000.0, events[1].Dur)
+		require.Equal(t, 1.0, events[1].Args["gc"])
+	})
+
+	t.Run("error", func(t *testing.T) {
+		source := annotationFunc(func(func(Annotation)) error { return errors.New("whups") })
+		trace := Config{Dst: Writer(&bytes.Buffer{}), ExecutionTrace: source}.Trace()
+		require.EqualError(t, trace.Stop(), "execution trace: whups")
+	})
+
+	t.Run("ignored-by-handlers", func(t *testing.T) {
+		// ServeHTTP() and Middleware() start a trace per request, which would
+		// all read from the same source.
+		var reads int32
+		source := annotationFunc(func(func(Annotation)) error {
+			atomic.AddInt32(&reads, 1)
+			return nil
+		})
+		conf := Config{Hz: 100, ExecutionTrace: source}
+		conf.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?seconds=0.01", nil))
+		handler := RequestConfig{
+			Config:     conf,
+			SampleRate: 1,
+			Dst:        func(string) io.WriteCloser { return Writer(io.Discard) },
+		}.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		require.Zero(t, atomic.LoadInt32(&reads))
+	})
+}
+
+// annotationFunc implements AnnotationSource.
+type annotationFunc func(annotate func(Annotation)) error
+
+func (f annotationFunc) ReadAnnotations(annotate func(Annotation)) error {
+	return f(annotate)
+}
+
+func Test_curGoroutineID(t *testing.T) {
+	id := curGoroutineID()
+	require.Greater(t, id, 0)
+	other := make(chan int)
+	go func() { other <- curGoroutineID() }()
+	require.NotEqual(t, id, <-other)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/felixge/fgtrace"
+	"github.com/felixge/fgtrace/internal"
+	"github.com/felixge/fgtrace/reader"
+)
+
+// convert writes all events of the trace in a different format.
+func convert(fs *flag.FlagSet, args []string, in input, stdout io.Writer) error {
+	var (
+		out    = fs.String("o", "", "output file, defaults to stdout")
+		format = fs.String("format", string(fgtrace.FormatPerfetto), "output format (json, perfetto or pprof)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r, closer, err := in()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	w, err := output(*out, stdout)
+	if err != nil {
+		return err
+	} else if err := convertEvents(r, w, fgtrace.Format(*format)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// convertEvents writes the events read from r to w in the given format.
+func convertEvents(r *reader.Reader, w io.Writer, format fgtrace.Format) error {
+	var (
+		enc *internal.Encoder
+		err error
+	)
+	switch format {
+	case fgtrace.FormatJSON:
+		enc, err = internal.NewEncoder(w)
+	case fgtrace.FormatPerfetto:
+		enc, err = internal.NewPerfettoEncoder(w)
+	case fgtrace.FormatPprof:
+		enc, err = internal.NewPprofEncoder(w)
+	default:
+		return fmt.Errorf("unknown format: %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		} else if err := enc.Event(ev); err != nil {
+			return err
+		}
+	}
+	return enc.Finish()
+}
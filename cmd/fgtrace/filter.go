@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/felixge/fgtrace/internal"
+	"github.com/felixge/fgtrace/reader"
+)
+
+// filter writes the span trees of the trace that match the given goroutines,
+// function and time window as a JSON trace. Events other than function calls
+// and metadata are dropped.
+func filter(fs *flag.FlagSet, args []string, in input, stdout io.Writer) error {
+	var (
+		out        = fs.String("o", "", "output file, defaults to stdout")
+		goroutines = fs.String("goroutines", "", "comma separated list of goroutine ids to keep")
+		funcRegexp = fs.String("func", "", "keep only the span trees of goroutines that call a function matching this regular expression")
+		start      = fs.Duration("start", 0, "drop everything before this offset from the start of the trace")
+		end        = fs.Duration("end", 0, "drop everything after this offset from the start of the trace")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f := spanFilter{Start: float64(start.Microseconds())}
+	if *end != 0 {
+		if *end < *start {
+			return fmt.Errorf("-end %s is before -start %s", *end, *start)
+		}
+		f.End = float64(end.Microseconds())
+	}
+	if *goroutines != "" {
+		f.Goroutines = map[int64]bool{}
+		for _, s := range strings.Split(*goroutines, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad goroutine id: %q", s)
+			}
+			f.Goroutines[id] = true
+		}
+	}
+	if *funcRegexp != "" {
+		var err error
+		if f.Func, err = regexp.Compile(*funcRegexp); err != nil {
+			return err
+		}
+	}
+
+	r, closer, err := in()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	w, err := output(*out, stdout)
+	if err != nil {
+		return err
+	} else if err := f.write(r, w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// write writes the spans read from r that are selected by f to w.
+func (f *spanFilter) write(r *reader.Reader, w io.Writer) error {
+	enc, err := internal.NewEncoder(w)
+	if err != nil {
+		return err
+	}
+	sr := reader.NewSpanReader(r)
+	named := map[int64]bool{}
+	for first := true; ; first = false {
+		root, err := sr.Next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// The metadata is at the beginning of the trace, so it is known once the
+		// first span has been read.
+		if first {
+			if err := encodeMeta(enc, r); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+
+		root = f.apply(root)
+		if root == nil {
+			continue
+		}
+		if !named[root.Pid] {
+			named[root.Pid] = true
+			if name, ok := r.GoroutineName(root.Pid); ok {
+				ev := &internal.Event{Name: "process_name", Ph: "M", Pid: root.Pid, Tid: root.Tid, Args: map[string]interface{}{"name": name}}
+				if err := enc.Event(ev); err != nil {
+					return err
+				}
+			}
+		}
+		if err := encodeSpan(enc, root); err != nil {
+			return err
+		}
+	}
+	return enc.Finish()
+}
+
+// spanFilter selects span trees. The zero value selects everything.
+type spanFilter struct {
+	Goroutines map[int64]bool
+	Func       *regexp.Regexp
+	Start      float64
+	End        float64 // 0 means no end
+}
+
+// apply returns root clipped to the time window of f, or nil if root is not
+// selected by f.
+func (f *spanFilter) apply(root *reader.Span) *reader.Span {
+	if f.Goroutines != nil && !f.Goroutines[root.Pid] {
+		return nil
+	}
+	if f.Func != nil {
+		match := false
+		root.Walk(func(s *reader.Span) { match = match || f.Func.MatchString(s.Func) })
+		if !match {
+			return nil
+		}
+	}
+	return f.clip(root, nil)
+}
+
+// clip returns a copy of span and its descendants that are limited to the time
+// window of f, or nil if span is outside of it.
+func (f *spanFilter) clip(span, parent *reader.Span) *reader.Span {
+	if span.End < f.Start || (f.End != 0 && span.Start > f.End) {
+		return nil
+	}
+	clipped := *span
+	clipped.Parent = parent
+	clipped.Children = nil
+	if clipped.Start < f.Start {
+		clipped.Start = f.Start
+	}
+	if f.End != 0 && clipped.End > f.End {
+		clipped.End = f.End
+	}
+	for _, child := range span.Children {
+		if c := f.clip(child, &clipped); c != nil {
+			clipped.Children = append(clipped.Children, c)
+		}
+	}
+	return &clipped
+}
+
+// encodeMeta encodes the trace metadata read by r so far.
+func encodeMeta(enc *internal.Encoder, r *reader.Reader) error {
+	if hz := r.Hz(); hz != 0 {
+		if err := enc.CustomMeta("hz", hz); err != nil {
+			return err
+		}
+	}
+	if states := r.StateFrames(); states != "" {
+		if err := enc.CustomMeta("state_frames", states); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeSpan encodes the begin and end events of span and its descendants.
+func encodeSpan(enc *internal.Encoder, span *reader.Span) error {
+	ev := &internal.Event{Name: span.Func, Ph: "B", Ts: span.Start, Pid: span.Pid, Tid: span.Tid, Args: span.Args}
+	if err := enc.Event(ev); err != nil {
+		return err
+	}
+	for _, child := range span.Children {
+		if err := encodeSpan(enc, child); err != nil {
+			return err
+		}
+	}
+	ev.Ph, ev.Ts, ev.Args = "E", span.End, nil
+	return enc.Event(ev)
+}
@@ -0,0 +1,139 @@
+// Command fgtrace analyzes and converts traces written by fgtrace in the JSON
+// format.
+//
+// Usage:
+//
+//	fgtrace <command> [flags] <file>
+//
+// The commands are:
+//
+//	summarize  print the top functions and states by wall time per goroutine
+//	filter     write a trace that only contains the selected goroutines,
+//	           functions or time window
+//	convert    write the trace in a different format, e.g. as a pprof profile
+//	stats      print event counts, duration and other trace metadata
+//
+// A file name of "-" reads the trace from stdin. Gzip compressed traces are
+// decompressed automatically, and output files ending with ".gz" are written
+// compressed. Run "fgtrace <command> -h" for the flags of each command.
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/felixge/fgtrace/internal"
+	"github.com/felixge/fgtrace/reader"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "fgtrace: %s\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// command is a subcommand of the fgtrace tool.
+type command struct {
+	Name  string
+	Usage string
+	Run   func(fs *flag.FlagSet, args []string, in input, stdout io.Writer) error
+}
+
+var commands = []command{
+	{"summarize", "print the top functions and states by wall time per goroutine", summarize},
+	{"filter", "write a trace that only contains the selected goroutines, functions or time window", filter},
+	{"convert", "write the trace in a different format", convert},
+	{"stats", "print event counts, duration and other trace metadata", stats},
+}
+
+// input opens the trace file given on the command line.
+type input func() (*reader.Reader, io.Closer, error)
+
+// run executes the command given by args.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		usage(stderr)
+		return flag.ErrHelp
+	}
+	for _, cmd := range commands {
+		if cmd.Name != args[0] {
+			continue
+		}
+
+		fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		fs.Usage = func() {
+			fmt.Fprintf(stderr, "usage: fgtrace %s [flags] <file>\n\n%s\n\n", cmd.Name, cmd.Usage)
+			fs.PrintDefaults()
+		}
+		in := func() (*reader.Reader, io.Closer, error) {
+			if fs.NArg() != 1 {
+				fs.Usage()
+				return nil, nil, errors.New("expected exactly one file argument")
+			} else if fs.Arg(0) == "-" {
+				r, err := decompress(stdin)
+				return reader.NewReader(r), nopCloser{}, err
+			}
+			file, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return nil, nil, err
+			}
+			r, err := decompress(file)
+			if err != nil {
+				file.Close()
+				return nil, nil, err
+			}
+			return reader.NewReader(r), file, nil
+		}
+		return cmd.Run(fs, args[1:], in, stdout)
+	}
+	usage(stderr)
+	return fmt.Errorf("unknown command: %q", args[0])
+}
+
+// nopCloser is the io.Closer for stdin, which is left open.
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func usage(w io.Writer) {
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, fmt.Sprintf("  %-10s %s", cmd.Name, cmd.Usage))
+	}
+	fmt.Fprintf(w, "usage: fgtrace <command> [flags] <file>\n\ncommands:\n%s\n", strings.Join(names, "\n"))
+}
+
+// decompress returns a reader that decompresses r if it starts with the gzip
+// magic number, or a reader that returns the data of r as is.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// output returns the file to write to for the -o flag value path, or stdout
+// if path is empty. Files ending with ".gz" are gzip compressed.
+func output(path string, stdout io.Writer) (io.WriteCloser, error) {
+	if path == "" {
+		return internal.WriteNopCloser(stdout), nil
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	} else if strings.HasSuffix(path, ".gz") {
+		return internal.NewGzipWriter(file), nil
+	}
+	return file, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/felixge/fgtrace/internal"
+	"github.com/stretchr/testify/require"
+)
+
+const testTrace = `[{"name":"hz","ph":"M","ts":0,"args":{"hz":100}}
+,{"name":"state_frames","ph":"M","ts":0,"args":{"state_frames":"root"}}
+,{"name":"process_name","ph":"M","ts":0,"pid":1,"tid":1,"args":{"name":"G1"}}
+,{"name":"running","ph":"B","ts":0,"pid":1,"tid":1}
+,{"name":"main.main","ph":"B","ts":0,"pid":1,"tid":1}
+,{"name":"main.a","ph":"B","ts":0,"pid":1,"tid":1}
+,{"name":"main.a","ph":"E","ts":10000,"pid":1,"tid":1}
+,{"name":"main.main","ph":"E","ts":10000,"pid":1,"tid":1}
+,{"name":"running","ph":"E","ts":10000,"pid":1,"tid":1}
+,{"name":"process_name","ph":"M","ts":0,"pid":2,"tid":1,"args":{"name":"G2 main.main"}}
+,{"name":"chan receive","ph":"B","ts":10000,"pid":2,"tid":1}
+,{"name":"main.worker","ph":"B","ts":10000,"pid":2,"tid":1}
+,{"name":"sleep","ph":"B","ts":10000,"pid":1,"tid":1}
+,{"name":"main.main","ph":"B","ts":10000,"pid":1,"tid":1}
+,{"name":"main.b","ph":"B","ts":10000,"pid":1,"tid":1}
+,{"name":"main.worker","ph":"E","ts":20000,"pid":2,"tid":1}
+,{"name":"chan receive","ph":"E","ts":20000,"pid":2,"tid":1}
+,{"name":"main.b","ph":"E","ts":40000,"pid":1,"tid":1}
+,{"name":"main.main","ph":"E","ts":40000,"pid":1,"tid":1}
+,{"name":"sleep","ph":"E","ts":40000,"pid":1,"tid":1}
+]`
+
+func TestRun(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fgtrace.json")
+	require.NoError(t, os.WriteFile(file, []byte(testTrace), 0644))
+
+	runCmd := func(t *testing.T, args ...string) string {
+		var stdout, stderr bytes.Buffer
+		require.NoError(t, run(args, strings.NewReader(testTrace), &stdout, &stderr))
+		return stdout.String()
+	}
+
+	t.Run("summarize", func(t *testing.T) {
+		require.Equal(t, strings.Join([]string{
+			"G1 (wall 40ms)",
+			"  STATE      WALL  %",
+			"  sleep      30ms  75.0%",
+			"  running    10ms  25.0%",
+			"  FUNCTION   WALL  %",
+			"  main.main  40ms  100.0%",
+			"  main.b     30ms  75.0%",
+			"",
+			"G2 main.main (wall 10ms)",
+			"  STATE         WALL  %",
+			"  chan receive  10ms  100.0%",
+			"  FUNCTION      WALL  %",
+			"  main.worker   10ms  100.0%",
+			"",
+		}, "\n"), runCmd(t, "summarize", "-top", "2", file))
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		out := runCmd(t, "filter", "-func", `^main\.b$`, "-end", "20ms", "-")
+		data, err := internal.Unmarshal([]byte(out))
+		require.NoError(t, err)
+		require.Equal(t, []*internal.Event{
+			{Name: "hz", Ph: "M", Args: map[string]interface{}{"hz": float64(100)}},
+			{Name: "state_frames", Ph: "M", Args: map[string]interface{}{"state_frames": "root"}},
+			{Name: "process_name", Ph: "M", Pid: 1, Tid: 1, Args: map[string]interface{}{"name": "G1"}},
+			{Name: "sleep", Ph: "B", Ts: 10000, Pid: 1, Tid: 1},
+			{Name: "main.main", Ph: "B", Ts: 10000, Pid: 1, Tid: 1},
+			{Name: "main.b", Ph: "B", Ts: 10000, Pid: 1, Tid: 1},
+			{Name: "main.b", Ph: "E", Ts: 20000, Pid: 1, Tid: 1},
+			{Name: "main.main", Ph: "E", Ts: 20000, Pid: 1, Tid: 1},
+			{Name: "sleep", Ph: "E", Ts: 20000, Pid: 1, Tid: 1},
+		}, data.Events)
+
+		out = runCmd(t, "filter", "-goroutines", "2", file)
+		data, err = internal.Unmarshal([]byte(out))
+		require.NoError(t, err)
+		require.Equal(t, 7, data.Len())
+	})
+
+	t.Run("convert", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "fgtrace.pftrace")
+		require.Equal(t, "", runCmd(t, "convert", "-format", "perfetto", "-o", out, file))
+		data, err := os.ReadFile(out)
+		require.NoError(t, err)
+		require.NotEmpty(t, data)
+
+		converted, err := internal.Unmarshal([]byte(runCmd(t, "convert", "-format", "json", file)))
+		require.NoError(t, err)
+		original, err := internal.Unmarshal([]byte(testTrace))
+		require.NoError(t, err)
+		require.Equal(t, original, converted)
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		gzFile := filepath.Join(t.TempDir(), "fgtrace.json.gz")
+		require.Equal(t, "", runCmd(t, "convert", "-format", "json", "-o", gzFile, file))
+		data, err := os.ReadFile(gzFile)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x1f, 0x8b}, data[:2])
+
+		converted, err := internal.Unmarshal([]byte(runCmd(t, "convert", "-format", "json", gzFile)))
+		require.NoError(t, err)
+		original, err := internal.Unmarshal([]byte(testTrace))
+		require.NoError(t, err)
+		require.Equal(t, original, converted)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		require.Equal(t, strings.Join([]string{
+			"events:       20",
+			"  B:          8",
+			"  E:          8",
+			"  M:          4",
+			"goroutines:   2",
+			"duration:     40ms",
+			"hz:           100",
+			"state_frames: root",
+			"",
+		}, "\n"), runCmd(t, "stats", file))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		require.Error(t, run(nil, nil, &stdout, &stderr))
+		require.Error(t, run([]string{"foo"}, nil, &stdout, &stderr))
+		require.Error(t, run([]string{"stats"}, nil, &stdout, &stderr))
+		require.Error(t, run([]string{"convert", "-format", "foo", file}, nil, &stdout, &stderr))
+		require.Contains(t, stderr.String(), "usage: fgtrace")
+	})
+}
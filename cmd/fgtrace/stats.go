@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// stats prints the number of events by phase, the number of goroutines, the
+// duration and the metadata of the trace.
+func stats(fs *flag.FlagSet, args []string, in input, stdout io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r, closer, err := in()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	var (
+		events     int
+		phases     = map[string]int{}
+		goroutines = map[int64]bool{}
+		timed      bool // true once minTs and maxTs are set
+		minTs      float64
+		maxTs      float64
+	)
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		events++
+		phases[ev.Ph]++
+		if ev.Ph == "M" {
+			continue
+		}
+		if ev.Pid != 0 {
+			goroutines[ev.Pid] = true
+		}
+		if !timed || ev.Ts < minTs {
+			minTs = ev.Ts
+		}
+		if !timed || ev.Ts > maxTs {
+			maxTs = ev.Ts
+		}
+		timed = true
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "events:\t%d\n", events)
+	var names []string
+	for ph := range phases {
+		names = append(names, ph)
+	}
+	sort.Strings(names)
+	for _, ph := range names {
+		fmt.Fprintf(tw, "  %s:\t%d\n", ph, phases[ph])
+	}
+	fmt.Fprintf(tw, "goroutines:\t%d\n", len(goroutines))
+	fmt.Fprintf(tw, "duration:\t%s\n", usDuration(maxTs-minTs))
+	fmt.Fprintf(tw, "hz:\t%d\n", r.Hz())
+	if states := r.StateFrames(); states != "" {
+		fmt.Fprintf(tw, "state_frames:\t%s\n", states)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/felixge/fgtrace/reader"
+)
+
+// summarize prints the time each goroutine spent in each state as well as its
+// top functions by inclusive wall time.
+func summarize(fs *flag.FlagSet, args []string, in input, stdout io.Writer) error {
+	var (
+		top    = fs.Int("top", 10, "number of functions to print per goroutine, 0 prints all")
+		states = fs.String("state-frames", "", "where the trace has state frames (root, leaf or no), defaults to the value recorded in the trace or root")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	r, closer, err := in()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	summaries := map[int64]*goroutineSummary{}
+	sr := reader.NewSpanReader(r)
+	for {
+		root, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		gs, ok := summaries[root.Pid]
+		if !ok {
+			gs = &goroutineSummary{ID: root.Pid, Funcs: map[string]float64{}, States: map[string]float64{}}
+			gs.Name, _ = r.GoroutineName(root.Pid)
+			summaries[root.Pid] = gs
+		}
+		stateFrames := *states
+		if stateFrames == "" {
+			if stateFrames = r.StateFrames(); stateFrames == "" {
+				stateFrames = "root"
+			}
+		}
+		gs.add(root, stateFrames)
+	}
+
+	ids := make([]int64, 0, len(summaries))
+	for id := range summaries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	for i, id := range ids {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		summaries[id].print(tw, *top)
+	}
+	return tw.Flush()
+}
+
+// goroutineSummary holds the wall time of a goroutine, broken down by state
+// and function.
+type goroutineSummary struct {
+	ID     int64
+	Name   string
+	Wall   float64            // microseconds the goroutine was observed
+	Funcs  map[string]float64 // func -> inclusive microseconds
+	States map[string]float64 // state -> microseconds
+}
+
+// add adds the span tree of root to the summary.
+func (s *goroutineSummary) add(root *reader.Span, stateFrames string) {
+	s.Wall += root.End - root.Start
+
+	// Count recursive calls only once by ignoring spans whose function is
+	// already active.
+	active := map[string]int{}
+	var visit func(span *reader.Span)
+	visit = func(span *reader.Span) {
+		duration := span.End - span.Start
+		if isStateSpan(span, stateFrames) {
+			s.States[span.Func] += duration
+		} else if active[span.Func] == 0 {
+			s.Funcs[span.Func] += duration
+		}
+		active[span.Func]++
+		for _, child := range span.Children {
+			visit(child)
+		}
+		active[span.Func]--
+	}
+	visit(root)
+}
+
+func (s *goroutineSummary) print(w io.Writer, top int) {
+	fmt.Fprintf(w, "%s (wall %s)\n", s.Name, usDuration(s.Wall))
+	if len(s.States) > 0 {
+		fmt.Fprintf(w, "  STATE\tWALL\t%%\n")
+		for _, e := range sortedEntries(s.States, 0) {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", e.Name, usDuration(e.Value), percent(e.Value, s.Wall))
+		}
+	}
+	fmt.Fprintf(w, "  FUNCTION\tWALL\t%%\n")
+	for _, e := range sortedEntries(s.Funcs, top) {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", e.Name, usDuration(e.Value), percent(e.Value, s.Wall))
+	}
+}
+
+// isStateSpan returns true if span is a virtual goroutine state frame.
+func isStateSpan(span *reader.Span, stateFrames string) bool {
+	switch stateFrames {
+	case "root":
+		return span.Parent == nil
+	case "leaf":
+		// State frames are the leaf of every sampled stack, so all other spans
+		// have children.
+		return len(span.Children) == 0
+	default:
+		return false
+	}
+}
+
+type entry struct {
+	Name  string
+	Value float64
+}
+
+// sortedEntries returns the top n entries of m ordered by descending value,
+// or all entries if n is 0.
+func sortedEntries(m map[string]float64, n int) []entry {
+	entries := make([]entry, 0, len(m))
+	for name, value := range m {
+		entries = append(entries, entry{Name: name, Value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// usDuration returns the duration for a number of microseconds.
+func usDuration(us float64) time.Duration {
+	return time.Duration(us * float64(time.Microsecond)).Round(time.Microsecond)
+}
+
+func percent(value, total float64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", value/total*100)
+}
@@ -0,0 +1,79 @@
+// Command fgtrace-import converts a Go execution trace written by
+// runtime/trace into a trace, see exectrace.Convert().
+//
+// Usage:
+//
+//	fgtrace-import [flags] <file>
+//
+// A file name of "-" reads the execution trace from stdin, and output files
+// ending with ".gz" are written compressed. Run "fgtrace-import -h" for the
+// flags.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/felixge/fgtrace"
+	"github.com/felixge/fgtrace/exectrace"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "fgtrace-import: %s\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// run converts the execution trace given by args.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("fgtrace-import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: fgtrace-import [flags] <file>\n\nconvert a Go execution trace written by runtime/trace into a trace\n\n")
+		fs.PrintDefaults()
+	}
+	var (
+		out         = fs.String("o", "", "output file, defaults to stdout")
+		format      = fs.String("format", string(fgtrace.FormatPerfetto), "output format (json, perfetto or pprof)")
+		stateFrames = fs.String("state-frames", string(fgtrace.StateFramesRoot), "where to add goroutine state frames (root, leaf or no)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one file argument")
+	}
+
+	r := stdin
+	if fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	return exectrace.Convert(fgtrace.Config{
+		Dst:         output(*out, stdout),
+		Format:      fgtrace.Format(*format),
+		StateFrames: fgtrace.StateFrames(*stateFrames),
+	}, r)
+}
+
+// output returns the destination for the -o flag value path, or stdout if
+// path is empty. Files ending with ".gz" are gzip compressed.
+func output(path string, stdout io.Writer) io.WriteCloser {
+	if path == "" {
+		return fgtrace.Writer(stdout)
+	} else if strings.HasSuffix(path, ".gz") {
+		return fgtrace.GzipFile(path)
+	}
+	return fgtrace.File(path)
+}
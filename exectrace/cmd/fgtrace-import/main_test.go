@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	rtrace "runtime/trace"
+	"testing"
+	"time"
+
+	"github.com/felixge/fgtrace/reader"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	execTrace := &bytes.Buffer{}
+	require.NoError(t, rtrace.Start(execTrace))
+	time.Sleep(time.Millisecond)
+	rtrace.Stop()
+	file := filepath.Join(t.TempDir(), "trace.out")
+	require.NoError(t, os.WriteFile(file, execTrace.Bytes(), 0644))
+
+	t.Run("file", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		require.NoError(t, run([]string{"-format", "json", "-state-frames", "leaf", file}, nil, &stdout, &stderr))
+		tr := reader.NewReader(&stdout)
+		var sleeps int
+		for {
+			e, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if e.Name == "sleep" {
+				sleeps++
+			}
+		}
+		require.Equal(t, "leaf", tr.StateFrames())
+		require.NotZero(t, sleeps)
+	})
+
+	t.Run("stdin", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "trace.json")
+		var stdout, stderr bytes.Buffer
+		require.NoError(t, run([]string{"-format", "json", "-o", out, "-"}, bytes.NewReader(execTrace.Bytes()), &stdout, &stderr))
+		require.Zero(t, stdout.Len())
+		file, err := os.Open(out)
+		require.NoError(t, err)
+		defer file.Close()
+		_, err = reader.NewSpanReader(reader.NewReader(file)).Next()
+		require.NoError(t, err)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		require.Error(t, run(nil, nil, &stdout, &stderr))
+		require.Contains(t, stderr.String(), "usage: fgtrace-import")
+		require.Error(t, run([]string{"-format", "foo", file}, nil, &stdout, &stderr))
+		require.Error(t, run([]string{filepath.Join(t.TempDir(), "missing")}, nil, &stdout, &stderr))
+	})
+}
@@ -0,0 +1,384 @@
+// Package exectrace integrates Go execution traces written by runtime/trace
+// with fgtrace. Annotations() merges their user regions, tasks and log events
+// into fgtrace traces, and Convert() turns them into fgtrace timelines.
+//
+// It's a separate module because parsing execution traces requires
+// golang.org/x/exp/trace and Go 1.25 or later, while fgtrace itself supports
+// older Go versions.
+package exectrace
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/DataDog/gostackparse"
+	"github.com/felixge/fgtrace"
+	exptrace "golang.org/x/exp/trace"
+)
+
+// Annotations returns a source for fgtrace.Config.ExecutionTrace that reads
+// the Go execution trace from r. It can be the reading end of an io.Pipe()
+// written to by runtime/trace.Start() or a trace.out file that was recorded at
+// the same time as the fgtrace trace. The events are aligned using the wall
+// clock snapshots of the execution trace, which are written by Go 1.25 and
+// later. Stopping the fgtrace trace waits until r returns io.EOF, so
+// runtime/trace.Stop() needs to be called and the pipe closed first. Besides
+// the user regions, tasks and log events, the source reports the GC cycles of
+// the execution trace as fgtrace.GCAnnotation.
+func Annotations(r io.Reader) fgtrace.AnnotationSource {
+	return annotationReader{r}
+}
+
+// annotationReader implements fgtrace.AnnotationSource for an execution trace.
+type annotationReader struct{ r io.Reader }
+
+// ReadAnnotations implements fgtrace.AnnotationSource.
+func (a annotationReader) ReadAnnotations(annotate func(fgtrace.Annotation)) error {
+	tr, err := exptrace.NewReader(a.r)
+	if err != nil {
+		return err
+	}
+
+	var snapshot *exptrace.ClockSnapshot
+	wall := func(ts exptrace.Time) time.Time {
+		return snapshot.Wall.Add(ts.Sub(snapshot.Trace))
+	}
+	user := newUserEvents()
+	for {
+		ev, err := tr.ReadEvent()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if ev.Kind() == exptrace.EventSync {
+			if s := ev.Sync().ClockSnapshot; s != nil {
+				snapshot = s
+			}
+			continue
+		} else if snapshot == nil {
+			return errors.New("execution trace has no clock snapshot, Go 1.25 or later is required")
+		}
+		if a, ok := user.annotation(ev, wall); ok {
+			annotate(a)
+		}
+	}
+}
+
+// newUserEvents returns an empty userEvents.
+func newUserEvents() *userEvents {
+	return &userEvents{
+		tasks:   map[exptrace.TaskID]*task{},
+		regions: map[exptrace.GoID][]region{},
+	}
+}
+
+// userEvents turns the user regions, tasks and log events as well as the GC
+// cycles of an execution trace into annotations. Regions, tasks and GC cycles
+// that began before the execution trace was started are ignored.
+type userEvents struct {
+	tasks   map[exptrace.TaskID]*task
+	regions map[exptrace.GoID][]region // open regions per goroutine
+	gc      time.Time                  // start of the current GC cycle or zero
+}
+
+// gcRange is the name of the range that the runtime reports for the duration
+// of a GC cycle, from the start of its concurrent mark phase to the end of
+// mark termination.
+const gcRange = "GC concurrent mark phase"
+
+// task is a task of an execution trace that has begun.
+type task struct {
+	ID    uint64 // replaces the id of the execution trace
+	Name  string
+	G     int
+	Start time.Time
+}
+
+// region is a region of an execution trace that has begun.
+type region struct {
+	Region exptrace.Region
+	Start  time.Time
+}
+
+// annotation returns the annotation for ev if it completes one. The at func
+// converts the timestamps of the execution trace.
+func (u *userEvents) annotation(ev exptrace.Event, at func(exptrace.Time) time.Time) (fgtrace.Annotation, bool) {
+	g := ev.Goroutine()
+	switch ev.Kind() {
+	case exptrace.EventTaskBegin:
+		// The ids of runtime/trace tasks are replaced, so they don't collide
+		// with the ones of fgtrace.NewTask().
+		u.tasks[ev.Task().ID] = &task{
+			ID:    fgtrace.NewTaskID(),
+			Name:  ev.Task().Type,
+			G:     int(g),
+			Start: at(ev.Time()),
+		}
+	case exptrace.EventTaskEnd:
+		t, ok := u.tasks[ev.Task().ID]
+		if !ok {
+			break
+		}
+		delete(u.tasks, ev.Task().ID)
+		return fgtrace.Annotation{
+			Kind:  fgtrace.TaskAnnotation,
+			G:     t.G,
+			ID:    t.ID,
+			Name:  t.Name,
+			Start: t.Start,
+			End:   at(ev.Time()),
+		}, true
+	case exptrace.EventRegionBegin:
+		u.regions[g] = append(u.regions[g], region{Region: ev.Region(), Start: at(ev.Time())})
+	case exptrace.EventRegionEnd:
+		open := u.regions[g]
+		if len(open) == 0 || open[len(open)-1].Region.Type != ev.Region().Type {
+			break
+		}
+		begin := open[len(open)-1]
+		u.regions[g] = open[:len(open)-1]
+		return fgtrace.Annotation{
+			Kind:  fgtrace.RegionAnnotation,
+			G:     int(g),
+			Name:  begin.Region.Type,
+			Start: begin.Start,
+			End:   at(ev.Time()),
+			Args:  u.taskArgs(begin.Region.Task),
+		}, true
+	case exptrace.EventLog:
+		log := ev.Log()
+		args := u.taskArgs(log.Task)
+		if args == nil {
+			args = map[string]interface{}{}
+		}
+		args["value"] = log.Message
+		return fgtrace.Annotation{
+			Kind:  fgtrace.LogAnnotation,
+			G:     int(g),
+			Name:  log.Category,
+			Start: at(ev.Time()),
+			End:   at(ev.Time()),
+			Args:  args,
+		}, true
+	case exptrace.EventRangeBegin:
+		if ev.Range().Name == gcRange {
+			u.gc = at(ev.Time())
+		}
+	case exptrace.EventRangeEnd:
+		if ev.Range().Name != gcRange || u.gc.IsZero() {
+			break
+		}
+		start := u.gc
+		u.gc = time.Time{}
+		return fgtrace.Annotation{
+			Kind:  fgtrace.GCAnnotation,
+			Name:  "GC",
+			Start: start,
+			End:   at(ev.Time()),
+		}, true
+	}
+	return fgtrace.Annotation{}, false
+}
+
+// taskArgs returns the args that label an annotation with the task with the
+// given id, or nil if the task is unknown.
+func (u *userEvents) taskArgs(id exptrace.TaskID) map[string]interface{} {
+	if t, ok := u.tasks[id]; ok {
+		return fgtrace.TaskArgs(t.Name, t.ID)
+	}
+	return nil
+}
+
+// Convert applies WithDefaults to c and converts the Go execution trace read
+// from r, see runtime/trace, into a trace that is written to c.Dst in
+// c.Format. Instead of being sampled, the stack of each goroutine is taken
+// from the events of the execution trace, e.g. when the goroutine blocks or a
+// CPU profile sample is taken, and its state from the scheduler's state
+// transitions. Between two events the last known stack is used, so traces
+// recorded with CPU profiling enabled are more accurate. The goroutines are
+// written by a fgtrace.Importer, which adds their states as virtual frames
+// according to c.StateFrames and filters them by c.Include and c.Exclude.
+// User regions, tasks, log events and GC cycles are added like for
+// Annotations(). Dst is closed when the conversion is done.
+//
+// The converted trace has no sample rate, so c.Hz is ignored and no "hz"
+// metadata is written, e.g. reader.Reader.Hz() returns 0 for it and
+// FormatPprof profiles have no period.
+func Convert(c fgtrace.Config, r io.Reader) error {
+	c = c.WithDefaults()
+	conv := &converter{c: c, goroutines: map[exptrace.GoID]*goroutine{}, user: newUserEvents()}
+	err := conv.convert(r)
+	if err == nil && conv.im == nil {
+		// The execution trace has no events.
+		conv.im, err = c.Import(execTime(0))
+	}
+	if conv.im == nil {
+		if closeErr := c.Dst.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	if finishErr := conv.im.Finish(execTime(conv.last)); finishErr != nil && err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+// converter converts the events of an execution trace into the per goroutine
+// stack timelines of a trace.
+type converter struct {
+	c          fgtrace.Config
+	im         *fgtrace.Importer // nil until the first event
+	start      exptrace.Time     // time of the first event
+	last       exptrace.Time     // time of the last event
+	goroutines map[exptrace.GoID]*goroutine
+	user       *userEvents
+}
+
+// goroutine is a goroutine of an execution trace.
+type goroutine struct {
+	ID          int
+	State       string
+	Stack       []*gostackparse.Frame // most recent stack, leaf first
+	CreatedBy   *gostackparse.Frame
+	CreatedByID int
+}
+
+// convert converts the events read from r.
+func (c *converter) convert(r io.Reader) error {
+	tr, err := exptrace.NewReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		ev, err := tr.ReadEvent()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := c.event(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// event converts ev.
+func (c *converter) event(ev exptrace.Event) error {
+	if c.im == nil {
+		im, err := c.c.Import(execTime(ev.Time()))
+		if err != nil {
+			return err
+		}
+		c.im, c.start = im, ev.Time()
+	}
+	c.last = ev.Time()
+
+	if a, ok := c.user.annotation(ev, execTime); ok {
+		if err := c.im.Annotate(a); err != nil {
+			return err
+		}
+	}
+
+	// Most events carry the stack of the goroutine executing them.
+	executing := ev.Goroutine()
+	if ev.Kind() == exptrace.EventStateTransition {
+		st := ev.StateTransition()
+		if st.Resource.Kind == exptrace.ResourceGoroutine {
+			if err := c.transition(ev, st); err != nil {
+				return err
+			} else if st.Resource.Goroutine() == executing {
+				return nil
+			}
+		}
+	}
+	if g, ok := c.goroutines[executing]; ok && ev.Stack() != exptrace.NoStack {
+		g.Stack = execStack(ev.Stack())
+		return c.encode(ev.Time(), g, false)
+	}
+	return nil
+}
+
+// transition applies the goroutine state transition st of ev.
+func (c *converter) transition(ev exptrace.Event, st exptrace.StateTransition) error {
+	id := st.Resource.Goroutine()
+	from, to := st.Goroutine()
+	g, ok := c.goroutines[id]
+	if to == exptrace.GoNotExist {
+		if !ok {
+			return nil
+		}
+		delete(c.goroutines, id)
+		return c.im.Exit(execTime(ev.Time()), g.ID)
+	}
+
+	ts := ev.Time()
+	if !ok {
+		g = &goroutine{ID: int(id)}
+		c.goroutines[id] = g
+		if from == exptrace.GoUndetermined {
+			// The goroutine had no events so far, so it has been in its state
+			// since the trace started, e.g. while blocked for the whole trace.
+			ts = c.start
+		}
+	}
+
+	created := from == exptrace.GoNotExist && ev.Goroutine() != exptrace.NoGoroutine
+	if created {
+		g.CreatedByID = int(ev.Goroutine())
+		if stack := execStack(ev.Stack()); len(stack) > 0 {
+			g.CreatedBy = stack[0]
+		}
+	}
+	if st.Stack != exptrace.NoStack {
+		g.Stack = execStack(st.Stack)
+	}
+	g.State = execState(to, st.Reason)
+	return c.encode(ts, g, created)
+}
+
+// encode passes the current state and stack of g at ts to the importer.
+func (c *converter) encode(ts exptrace.Time, g *goroutine, created bool) error {
+	current := &fgtrace.Goroutine{CreatedByID: g.CreatedByID}
+	current.ID = g.ID
+	current.State = g.State
+	current.CreatedBy = g.CreatedBy
+	current.Stack = append([]*gostackparse.Frame(nil), g.Stack...)
+	return c.im.Goroutine(execTime(ts), current, created)
+}
+
+// execTime converts the timestamp of an execution trace into a time.Time that
+// can only be compared to other converted timestamps.
+func execTime(t exptrace.Time) time.Time {
+	return time.Unix(0, int64(t))
+}
+
+// execStack converts s into a stack with the leaf frame first.
+func execStack(s exptrace.Stack) []*gostackparse.Frame {
+	var stack []*gostackparse.Frame
+	for f := range s.Frames() {
+		stack = append(stack, &gostackparse.Frame{Func: f.Func, File: f.File, Line: int(f.Line)})
+	}
+	return stack
+}
+
+// execState returns the name of the goroutine state to, using the reason of
+// the transition for waiting goroutines, e.g. "chan receive".
+func execState(to exptrace.GoState, reason string) string {
+	switch to {
+	case exptrace.GoRunning:
+		return "running"
+	case exptrace.GoRunnable:
+		return "runnable"
+	case exptrace.GoSyscall:
+		return "syscall"
+	case exptrace.GoWaiting:
+		if reason != "" {
+			return reason
+		}
+		return "waiting"
+	}
+	return "unknown"
+}
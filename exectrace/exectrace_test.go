@@ -0,0 +1,228 @@
+package exectrace
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"runtime"
+	rtrace "runtime/trace"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/felixge/fgtrace"
+	"github.com/felixge/fgtrace/reader"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotations(t *testing.T) {
+	t.Run("runtime/trace", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		require.NoError(t, rtrace.Start(pw))
+		buf := &bytes.Buffer{}
+		trace := fgtrace.Config{Dst: fgtrace.Writer(buf), Hz: 100, ExecutionTrace: Annotations(pr)}.Trace()
+
+		ctx, task := rtrace.NewTask(context.Background(), "job")
+		rtrace.WithRegion(ctx, "step", func() { time.Sleep(2 * time.Millisecond) })
+		rtrace.Log(ctx, "rows", "42")
+		task.End()
+
+		rtrace.Stop()
+		require.NoError(t, pw.Close())
+		require.NoError(t, trace.Stop())
+
+		var events []*reader.Event
+		for _, e := range readEvents(t, buf) {
+			if e.Tid == annotationTid && e.Ph != "M" {
+				events = append(events, e)
+			}
+		}
+		require.Len(t, events, 4)
+
+		g := int64(curGoroutineID())
+		step, rows, begin, end := events[0], events[1], events[2], events[3]
+		taskArgs := map[string]interface{}{"task": "job", "task_id": float64(begin.ID)}
+		require.Equal(t, "step", step.Name)
+		require.Equal(t, "X", step.Ph)
+		require.Equal(t, g, step.Pid)
+		require.GreaterOrEqual(t, step.Dur, 2000.0)
+		require.Greater(t, step.Ts, 0.0)
+		require.Equal(t, taskArgs, step.Args)
+
+		require.Equal(t, "rows", rows.Name)
+		require.Equal(t, "i", rows.Ph)
+		require.GreaterOrEqual(t, rows.Ts, step.Ts+step.Dur)
+		taskArgs["value"] = "42"
+		require.Equal(t, taskArgs, rows.Args)
+
+		require.Equal(t, "job", begin.Name)
+		require.Equal(t, "b", begin.Ph)
+		require.Equal(t, g, begin.Pid)
+		require.Equal(t, "e", end.Ph)
+		require.LessOrEqual(t, begin.Ts, step.Ts)
+		require.GreaterOrEqual(t, end.Ts, rows.Ts)
+	})
+
+	t.Run("gc", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		require.NoError(t, rtrace.Start(pw))
+		buf := &bytes.Buffer{}
+		trace := fgtrace.Config{Dst: fgtrace.Writer(buf), Hz: 100, ExecutionTrace: Annotations(pr)}.Trace()
+		runtime.GC()
+		rtrace.Stop()
+		require.NoError(t, pw.Close())
+		require.NoError(t, trace.Stop())
+
+		requireGCCycles(t, readEvents(t, buf))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		trace := fgtrace.Config{Dst: fgtrace.Writer(io.Discard), ExecutionTrace: Annotations(strings.NewReader("not a trace"))}.Trace()
+		err := trace.Stop()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "execution trace: ")
+	})
+}
+
+func TestConvert(t *testing.T) {
+	t.Run("runtime/trace", func(t *testing.T) {
+		execTrace := &bytes.Buffer{}
+		require.NoError(t, rtrace.Start(execTrace))
+		ch := make(chan struct{})
+		go func() {
+			rtrace.WithRegion(context.Background(), "wait", func() { <-ch })
+		}()
+		time.Sleep(5 * time.Millisecond)
+		close(ch)
+		time.Sleep(5 * time.Millisecond)
+		rtrace.Stop()
+
+		buf := &bytes.Buffer{}
+		err := Convert(fgtrace.Config{Dst: fgtrace.Writer(buf)}, execTrace)
+		require.NoError(t, err)
+
+		events := readEvents(t, buf)
+		require.Equal(t, "M", events[0].Ph)
+		require.Equal(t, "state_frames", events[0].Name)
+		for _, e := range events {
+			require.NotEqual(t, "hz", e.Name)
+		}
+
+		var begins, ends int
+		var wait, sleep bool
+		for _, e := range events {
+			switch e.Ph {
+			case "B":
+				begins++
+				wait = wait || e.Name == "chan receive"
+				sleep = sleep || e.Name == "sleep"
+			case "E":
+				ends++
+			case "X":
+				if e.Pid == runtimePid {
+					// A GC cycle.
+					break
+				}
+				require.Equal(t, "wait", e.Name)
+				require.Equal(t, int64(annotationTid), e.Tid)
+				require.GreaterOrEqual(t, e.Dur, 4000.0)
+			}
+		}
+		require.Equal(t, begins, ends)
+		require.True(t, wait, "chan receive state frame")
+		require.True(t, sleep, "sleep state frame")
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		execTrace := &bytes.Buffer{}
+		require.NoError(t, rtrace.Start(execTrace))
+		time.Sleep(time.Millisecond)
+		rtrace.Stop()
+
+		buf := &bytes.Buffer{}
+		include := fgtrace.Filter{Func: regexp.MustCompile(`TestConvert\.func2$`)}
+		err := Convert(fgtrace.Config{Dst: fgtrace.Writer(buf), Include: include}, execTrace)
+		require.NoError(t, err)
+
+		g := int64(curGoroutineID())
+		var begins int
+		for _, e := range readEvents(t, buf) {
+			if e.Ph == "B" {
+				require.Equal(t, g, e.Pid)
+				begins++
+			}
+		}
+		require.Greater(t, begins, 0)
+	})
+
+	t.Run("gc", func(t *testing.T) {
+		execTrace := &bytes.Buffer{}
+		require.NoError(t, rtrace.Start(execTrace))
+		runtime.GC()
+		rtrace.Stop()
+
+		buf := &bytes.Buffer{}
+		require.NoError(t, Convert(fgtrace.Config{Dst: fgtrace.Writer(buf)}, execTrace))
+		requireGCCycles(t, readEvents(t, buf))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		err := Convert(fgtrace.Config{Dst: fgtrace.Writer(io.Discard)}, strings.NewReader("not a trace"))
+		require.Error(t, err)
+	})
+}
+
+const (
+	// annotationTid is the tid of the annotation track of a goroutine.
+	annotationTid = 2
+	// runtimePid is the pid of the "runtime" process.
+	runtimePid = 0
+	// gcCycleTid is the tid of the "GC cycles" track of the "runtime" process.
+	gcCycleTid = 3
+)
+
+// requireGCCycles asserts that events contain at least one GC cycle on the
+// "GC cycles" track.
+func requireGCCycles(t *testing.T, events []*reader.Event) {
+	t.Helper()
+	var cycles int
+	for _, e := range events {
+		if e.Pid != runtimePid || e.Tid != gcCycleTid || e.Ph != "X" {
+			continue
+		}
+		require.Equal(t, "GC", e.Name)
+		require.Greater(t, e.Dur, 0.0)
+		cycles++
+	}
+	require.Greater(t, cycles, 0)
+}
+
+// readEvents returns the events of the JSON trace read from r.
+func readEvents(t *testing.T, r io.Reader) []*reader.Event {
+	t.Helper()
+	var events []*reader.Event
+	tr := reader.NewReader(r)
+	for {
+		e, err := tr.Next()
+		if err == io.EOF {
+			return events
+		}
+		require.NoError(t, err)
+		events = append(events, e)
+	}
+}
+
+// curGoroutineID returns the id of the calling goroutine, which is parsed from
+// the header of its stack trace, e.g. "goroutine 18 [running]:".
+func curGoroutineID() int {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.Atoi(string(b))
+	return id
+}
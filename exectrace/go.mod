@@ -0,0 +1,16 @@
+module github.com/felixge/fgtrace/exectrace
+
+go 1.25.0
+
+require (
+	github.com/DataDog/gostackparse v0.6.0
+	github.com/felixge/fgtrace v0.0.0-20261017183831-8f931313208b
+	github.com/stretchr/testify v1.7.1
+	golang.org/x/exp v0.0.0-20260611194520-c48552f49976
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
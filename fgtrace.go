@@ -1,14 +1,15 @@
 package fgtrace
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"runtime"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/DataDog/gostackparse"
@@ -17,31 +18,127 @@ import (
 
 const (
 	defaultFile         = "fgtrace.json"
+	defaultPerfettoFile = "fgtrace.pftrace"
+	defaultPprofFile    = "fgtrace.pprof"
 	defaultHz           = 99
 	defaultHTTPDuration = 30 * time.Second
 	defaultStateFrames  = StateFramesRoot
+	defaultFormat       = FormatJSON
 )
 
 // Config configures the capturing of traces as well as serving them via http.
 // The zero value is a valid configuration.
 type Config struct {
 	// Hz determines how often the stack traces of all goroutines are captured
-	// per second. WithDefaults() sets it to 99 Hz if it is 0.
+	// per second. WithDefaults() sets it to 99 Hz if it is 0. It is the max
+	// rate if OverheadBudget is set.
 	Hz int
+	// OverheadBudget enables adaptive sampling if it is greater than 0. It is
+	// the max fraction of wall time that may be spent capturing and encoding
+	// samples, e.g. 0.01 for 1%. The rate is adjusted after every sample to
+	// stay within the budget, but it never exceeds Hz or drops below 1 Hz.
+	// Every change of the rate is recorded as an "hz" instant event.
+	OverheadBudget float64
 	// IncludeSelf controls if the trace contains its own internal goroutines.
 	// It's disabled by default because they are usually not of interest.
 	IncludeSelf bool
+	// Include limits the trace to goroutines matching the filter. The zero
+	// value includes all goroutines.
+	Include Filter
+	// Exclude removes goroutines matching the filter from the trace. The zero
+	// value excludes no goroutines.
+	Exclude Filter
+	// CallerTree limits the trace to the goroutine calling Trace() and the
+	// goroutines it starts, directly or indirectly, while the trace is
+	// running, e.g. to trace a benchmark or a batch job without the noise of
+	// the rest of the process. Goroutines that already exist when Trace() is
+	// called are not included, and IncludeSelf has no effect. It requires a
+	// Profiler that reports goroutine ids and creators, i.e.
+	// NewStackProfiler(), Trace.Stop() returns an error for
+	// NewRecordProfiler(). Descendants are found by the ids of their creators,
+	// which runtime.Stack() reports since Go 1.21, so older Go versions only
+	// trace the calling goroutine. A goroutine whose creator started and exited
+	// between two samples can't be linked to the tree, so it and its
+	// descendants are missing from the trace. It is ignored by ServeHTTP() and
+	// Watchers.
+	CallerTree bool
 	// StateFrames allows adding the state of goroutines as a virtual frame when
 	// their stack traces are captured. WithDefaults() sets it to StateFramesRoot
 	// if it is "".
 	StateFrames StateFrames
+	// CallSites causes stack frames to be distinguished by the file and line
+	// they were called from in addition to their function. This turns calls
+	// of the same function from different lines of its caller into separate
+	// slices, at the cost of a larger trace. The file and line of each frame
+	// are always included in the args of its begin event.
+	CallSites bool
+	// Metrics adds counter tracks for runtime metrics that are read from
+	// runtime/metrics at every sample: the number of goroutines, the bytes
+	// occupied by live and not yet swept heap objects, completed GC cycles,
+	// GOMAXPROCS, the 99th percentile of the scheduler latency since the
+	// previous sample and the time it took the Profiler to capture the
+	// goroutines, which stops the world for NewStackProfiler(). Metrics that
+	// are not supported by the runtime are omitted.
+	Metrics bool
+	// GCPauses adds the stop-the-world pauses of the garbage collector as
+	// slices to a dedicated "runtime" track. Only the pauses are recorded, as
+	// the runtime doesn't report the start of GC cycles outside of execution
+	// traces, see ExecutionTrace for adding the cycles. The runtime also
+	// reports the two pauses of a cycle as a single duration, so they are
+	// shown as one slice that ends with the last pause of the cycle. It's read
+	// from runtime/debug.ReadGCStats() at every sample.
+	GCPauses bool
+	// Overhead adds the time fgtrace spends in Profiler.Goroutines() as well
+	// as filtering and encoding each sample as slices to a dedicated "fgtrace
+	// overhead" track. A summary with the total and max time spent in the
+	// Profiler, the total encoding time, the achieved vs. the configured Hz
+	// and the number of missed ticks is written as "overhead" metadata when
+	// the trace is stopped.
+	Overhead bool
+	// ExecutionTrace merges the annotations of the source into the trace if
+	// it is not nil. Annotations that end before the trace starts are
+	// dropped, and stopping the trace waits until ReadAnnotations() returns.
+	// The Annotations() func of the github.com/felixge/fgtrace/exectrace
+	// module, which requires Go 1.25 or later, returns a source for the user
+	// regions, tasks and log events of a Go execution trace, see
+	// runtime/trace, as well as its GC cycles, which are added to a "GC
+	// cycles" track of the "runtime" process. A source can only be read by a
+	// single trace, so it is ignored by ServeHTTP(), Middleware() and
+	// Watchers, which start a trace for every request or capture, except for
+	// the continuous trace of a Watcher in flight recorder mode.
+	ExecutionTrace AnnotationSource
+	// Profiler captures the goroutines for each sample of the trace.
+	// WithDefaults() sets it to NewStackProfiler() if it is nil.
+	Profiler Profiler
+	// Format is the format traces are written in. WithDefaults() sets it to
+	// FormatJSON if it is "".
+	Format Format
 	// Dst is the destination for traces created by calling Trace().
-	// WithDefaults() sets it to File("fgtrace.json") if it is nil. Also see
-	// Writer().
+	// WithDefaults() sets it to File("fgtrace.json") if it is nil, or
+	// File("fgtrace.pftrace") for FormatPerfetto and File("fgtrace.pprof") for
+	// FormatPprof. Trace.Stop() closes it, use Writer() for destinations that
+	// should stay open.
 	Dst io.WriteCloser
 	// HTTPDuration is the default duration for traces served via ServeHTTP().
 	// WithDefaults() sets it to 30s if it is 0. It is ignored by Trace().
 	HTTPDuration time.Duration
+	// Window enables flight recorder mode if it is non-zero. Instead of
+	// streaming all events to Dst, only the goroutine samples of the most
+	// recent Window are kept in memory. They can be written at any time using
+	// Trace.Snapshot() and are written to Dst by Trace.Stop().
+	Window time.Duration
+	// WindowBytes enables flight recorder mode if it is non-zero and limits the
+	// approximate amount of memory used for keeping samples. It can be combined
+	// with Window.
+	WindowBytes int
+
+	// clock is the source of time for the trace, internal.RealClock{} if nil.
+	// It allows tests to control the trace loop.
+	clock internal.Clock
+	// trigger is the reason for a capture started by a Watcher.
+	trigger string
+	// root is the id of the goroutine that called Trace() with CallerTree.
+	root int
 }
 
 // StateFrames describes if and where virtual goroutine state frames are added.
@@ -59,6 +156,25 @@ const (
 	StateFramesNo StateFrames = "no"
 )
 
+// Format describes the file format of traces.
+type Format string
+
+const (
+	// FormatJSON causes traces to be written in the JSON based Trace Event
+	// Format.
+	FormatJSON Format = "json"
+	// FormatPerfetto causes traces to be written in Perfetto's protobuf based
+	// trace format. It's much more compact than FormatJSON and recommended for
+	// long traces or high Hz values.
+	FormatPerfetto Format = "perfetto"
+	// FormatPprof causes the wall clock time of the sampled goroutine stacks
+	// to be aggregated into a gzipped pprof profile that can be opened with
+	// "go tool pprof". The virtual state frames are included according to
+	// StateFrames, and the goroutine id and creator are added as the sample
+	// labels "goroutine" and "created_by". The timeline is not preserved.
+	FormatPprof Format = "pprof"
+)
+
 // assert interface implementation
 var _ http.Handler = Config{}
 
@@ -66,8 +182,18 @@ var _ http.Handler = Config{}
 // the type documentation. This is done automatically by Trace() and
 // ServeHTTP(), but can be useful to log the effective configuration.
 func (c Config) WithDefaults() Config {
+	if c.Format == "" {
+		c.Format = defaultFormat
+	}
 	if c.Dst == nil {
-		c.Dst = File(defaultFile)
+		switch c.Format {
+		case FormatPerfetto:
+			c.Dst = File(defaultPerfettoFile)
+		case FormatPprof:
+			c.Dst = File(defaultPprofFile)
+		default:
+			c.Dst = File(defaultFile)
+		}
 	}
 	if c.Hz == 0 {
 		c.Hz = defaultHz
@@ -78,26 +204,51 @@ func (c Config) WithDefaults() Config {
 	if c.StateFrames == "" {
 		c.StateFrames = defaultStateFrames
 	}
+	if c.Profiler == nil {
+		c.Profiler = NewStackProfiler()
+	}
 	return c
 }
 
 // Trace applies WithDefaults to c and starts capturing a trace at c.Hz to
 // c.Dst. Callers are responsible for calling Trace.Stop() to finish the trace.
 func (c Config) Trace() *Trace {
+	return c.TraceContext(context.Background())
+}
+
+// TraceContext is like Trace, but the trace is also stopped when ctx is done.
+// Callers should still call Trace.Stop() to wait for the trace to finish and
+// to check for errors.
+func (c Config) TraceContext(ctx context.Context) *Trace {
+	if c.CallerTree {
+		c.root = curGoroutineID()
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	t := &Trace{
-		c:       c.WithDefaults(),
-		stop:    make(chan struct{}),
-		stopped: make(chan error),
+		c:      c.WithDefaults(),
+		clock:  c.clock,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if t.clock == nil {
+		t.clock = internal.RealClock{}
 	}
-	t.start()
+	t.start(ctx)
 	return t
 }
 
 // ServeHTTP applies WithDefaults to c and serves a trace. The query
-// parameters "hz" and "seconds" can be used to overwrite the defaults.
+// parameters "hz", "seconds", "format", "call_sites", "metrics",
+// "gc_pauses", "overhead" and "overhead_budget" can be used to overwrite the
+// defaults. The parameters "include_func", "include_package",
+// "include_state" and "include_created_by" as well as their "exclude_"
+// counterparts add criteria to the Include and Exclude filters. The package
+// and state parameters may be given more than once. The trace ends early if
+// the request context is canceled, e.g. because the client disconnected.
+// Traces other than FormatPprof are gzip compressed if the Accept-Encoding
+// header of the request allows it.
 func (c Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c = c.WithDefaults()
-	c.Dst = Writer(w)
 
 	params := []struct {
 		Name string
@@ -129,22 +280,153 @@ func (c Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return nil
 			},
 		},
+		{
+			Name: "overhead_budget",
+			Fn: func(val string) error {
+				budget, err := strconv.ParseFloat(val, 64)
+				if err != nil {
+					return err
+				} else if budget <= 0 || budget > 1 {
+					return errors.New("invalid value")
+				}
+				c.OverheadBudget = budget
+				return nil
+			},
+		},
+		{
+			Name: "call_sites",
+			Fn: func(val string) (err error) {
+				c.CallSites, err = strconv.ParseBool(val)
+				return err
+			},
+		},
+		{
+			Name: "metrics",
+			Fn: func(val string) (err error) {
+				c.Metrics, err = strconv.ParseBool(val)
+				return err
+			},
+		},
+		{
+			Name: "gc_pauses",
+			Fn: func(val string) (err error) {
+				c.GCPauses, err = strconv.ParseBool(val)
+				return err
+			},
+		},
+		{
+			Name: "overhead",
+			Fn: func(val string) (err error) {
+				c.Overhead, err = strconv.ParseBool(val)
+				return err
+			},
+		},
+		{Name: "include_func", Fn: regexpParam(&c.Include.Func)},
+		{Name: "exclude_func", Fn: regexpParam(&c.Exclude.Func)},
+		{Name: "include_package", Fn: listParam(&c.Include.Packages)},
+		{Name: "exclude_package", Fn: listParam(&c.Exclude.Packages)},
+		{Name: "include_state", Fn: listParam(&c.Include.States)},
+		{Name: "exclude_state", Fn: listParam(&c.Exclude.States)},
+		{Name: "include_created_by", Fn: regexpParam(&c.Include.CreatedBy)},
+		{Name: "exclude_created_by", Fn: regexpParam(&c.Exclude.CreatedBy)},
+		{
+			Name: "format",
+			Fn: func(val string) error {
+				switch f := Format(val); f {
+				case FormatJSON, FormatPerfetto, FormatPprof:
+					c.Format = f
+					return nil
+				default:
+					return errors.New("invalid value")
+				}
+			},
+		},
 	}
 
+	query := r.URL.Query()
 	for _, p := range params {
-		val := r.URL.Query().Get(p.Name)
-		if val == "" {
-			continue
-		} else if err := p.Fn(val); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "bad %s: %q: %s\n", p.Name, val, err)
-			return
+		for _, val := range query[p.Name] {
+			if val == "" {
+				continue
+			} else if err := p.Fn(val); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "bad %s: %q: %s\n", p.Name, val, err)
+				return
+			}
+		}
+	}
+
+	c.Dst = Writer(w)
+	c.CallerTree = false
+	c.ExecutionTrace = nil
+	if c.Format != FormatPprof {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header.Values("Accept-Encoding")) {
+			w.Header().Set("Content-Encoding", "gzip")
+			c.Dst = internal.NewGzipWriter(c.Dst)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.HTTPDuration)
+	defer cancel()
+	trace := c.TraceContext(ctx)
+	if !trace.started {
+		err := trace.Stop()
+		w.Header().Del("Content-Encoding")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failed to start trace: %s\n", err)
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-trace.done:
+		// The trace stopped early because of an error.
+	}
+	trace.Stop()
+}
+
+// acceptsGzip returns true if the given Accept-Encoding header values allow a
+// gzip encoded response, i.e. they list "gzip" or "*" without a q-value of 0.
+func acceptsGzip(values []string) bool {
+	for _, val := range values {
+		for _, coding := range strings.Split(val, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if key == "q" {
+					q, _ = strconv.ParseFloat(val, 64)
+				}
+			}
+			if q > 0 {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	defer c.Trace().Stop()
-	time.Sleep(c.HTTPDuration)
+// regexpParam returns a ServeHTTP() param func that compiles its value into
+// dst.
+func regexpParam(dst **regexp.Regexp) func(string) error {
+	return func(val string) (err error) {
+		*dst, err = regexp.Compile(val)
+		return err
+	}
+}
 
+// listParam returns a ServeHTTP() param func that appends its value to dst.
+// The list is copied first to avoid modifying the slice of the Config the
+// handler was created from.
+func listParam(dst *[]string) func(string) error {
+	return func(val string) error {
+		*dst = append((*dst)[:len(*dst):len(*dst)], val)
+		return nil
+	}
 }
 
 // File is a helper for Config.Dst that returns an io.WriteCloser that creates
@@ -153,6 +435,44 @@ func File(name string) io.WriteCloser {
 	return internal.NewFileWriter(name)
 }
 
+// GzipFile is a helper for Config.Dst that returns an io.WriteCloser that
+// creates the file with the given name and writes gzip compressed data to it,
+// e.g. "fgtrace.json.gz". Perfetto and chrome://tracing open such files
+// directly. It's not useful for FormatPprof, which is already compressed.
+func GzipFile(name string) io.WriteCloser {
+	return internal.NewGzipWriter(internal.NewFileWriter(name))
+}
+
+// Rotation configures when RotatingFile() starts a new file.
+type Rotation struct {
+	// Interval starts a new file once the current one covers at least the
+	// given duration. Zero disables the limit.
+	Interval time.Duration
+	// MaxBytes starts a new file once the current one is at least the given
+	// size. Zero disables the limit. For compressed files the compressed size
+	// is used, which only grows when the compressor emits a block, so the limit
+	// is approximate and files may exceed it by up to a block of compressed
+	// data. It has no effect for FormatPprof, which writes its files when they
+	// are finished.
+	MaxBytes int64
+	// MaxFiles removes the oldest files if there are more than the given
+	// number. Zero keeps all files.
+	MaxFiles int
+}
+
+// RotatingFile is a helper for Config.Dst that returns an io.WriteCloser that
+// splits a continuous trace into a sequence of files, each of which is a valid
+// trace on its own: stacks that are still open when a file is finished are
+// ended in it and begun again at the start of the next file. The placeholders
+// "{seq}" and "{time}" in pattern are replaced by the sequence number and the
+// start time of each file, e.g. "fgtrace-{time}.json". If pattern contains
+// neither, "-{seq}" is inserted before its extension. If pattern ends with
+// ".gz", each file is gzip compressed like with GzipFile(). Files are only
+// rotated between samples and not in flight recorder mode (see Config.Window).
+func RotatingFile(pattern string, r Rotation) io.WriteCloser {
+	return internal.NewRotatingFileWriter(pattern, r.Interval, r.MaxBytes, r.MaxFiles)
+}
+
 // Writer is a helper for for Config.Dst that returns an io.WriteCloser that
 // writes to w and does nothing when Close() is called.
 func Writer(w io.Writer) io.WriteCloser {
@@ -161,127 +481,453 @@ func Writer(w io.Writer) io.WriteCloser {
 
 // Trace represents a trace that is being captured.
 type Trace struct {
-	c       Config            // config for the trace
-	err     error             // error that caused the tracer to stop
-	stop    chan struct{}     // closed to initiate stop
-	stopped chan error        // messaged to confirm stop completed
-	enc     *internal.Encoder // trace event format encoder
+	c         Config             // config for the trace
+	err       error              // error that caused the tracer to stop
+	cancel    context.CancelFunc // called to initiate stop
+	done      chan struct{}      // closed once the trace is finished and err is set
+	enc       *internal.Encoder  // trace event format encoder
+	rec       *recorder          // holds samples in flight recorder mode
+	clock     internal.Clock     // source of time
+	startTime time.Time          // time the trace was started
+	user      annotations        // user events for the next sample
+	imported  chan error         // result of reading Config.ExecutionTrace
+	tree      *goroutineTree     // goroutines of the trace if Config.root is set
+	started   bool               // false if start() failed
+
+	stopMu  sync.Mutex // guards stopped
+	stopped bool       // true after the first call to Stop()
 }
 
-func (t *Trace) start() {
-	if t.enc, t.err = internal.NewEncoder(t.c.Dst); t.err != nil {
+func (t *Trace) start(ctx context.Context) {
+	t.startTime = t.clock.Now()
+	if _, ok := t.c.Profiler.(*recordProfiler); ok && t.c.CallerTree {
+		t.err = errors.New("CallerTree requires a Profiler that reports goroutine ids and creators, e.g. NewStackProfiler()")
+		close(t.done)
+		return
+	}
+	if t.c.CallerTree {
+		t.tree = newGoroutineTree(t.c.root)
+	}
+	if r, ok := t.c.Dst.(*internal.RotatingFileWriter); ok {
+		r.Begin(t.startTime)
+	}
+	if t.c.Window != 0 || t.c.WindowBytes != 0 {
+		t.rec = &recorder{window: t.c.Window, maxBytes: t.c.WindowBytes}
+	}
+	if t.enc, t.err = newEncoder(t.c, t.c.Dst); t.err != nil {
+		close(t.done)
 		return
-	} else if t.err = t.enc.CustomMeta("hz", t.c.Hz); t.err != nil {
+	} else if t.err = t.encodeMeta(t.enc, t.c.trigger); t.err != nil {
+		close(t.done)
 		return
 	}
+	t.started = true
+	traces.add(t)
+	if t.c.ExecutionTrace != nil {
+		t.imported = make(chan error, 1)
+		go func() {
+			t.imported <- t.c.ExecutionTrace.ReadAnnotations(t.annotate)
+		}()
+	}
+
+	// Create the ticker before returning, so tests can't advance the clock
+	// before the trace loop is ready for it.
+	tick := t.clock.NewTicker(time.Second / time.Duration(t.c.Hz))
+	go func() {
+		defer close(t.done)
+		t.err = t.finish(t.trace(ctx, tick))
+	}()
+	if t.tree != nil {
+		// Goroutines that exist at the first sample can't join the tree, so
+		// the ones started by the caller after Trace() returns must not be
+		// captured by it.
+		select {
+		case <-t.tree.ready:
+		case <-t.done:
+		}
+	}
+}
 
-	go func() { t.stopped <- t.trace() }()
+// finish finishes the encoder and closes the configured dst after the trace
+// loop returned with err. It returns the first error encountered.
+func (t *Trace) finish(err error) error {
+	// TODO(fg) does the trace format support writing error messages? if yes,
+	// we should probably attempt to write the error to the file as well.
+	if finishErr := t.enc.Finish(); finishErr != nil && err == nil {
+		err = finishErr
+	}
+	// Destinations like GzipFile() and RotatingFile() only write their last
+	// data when they are closed, and File() leaks its file otherwise.
+	if closeErr := t.c.Dst.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // Stop stops the trace, calls Close() on the configured dst and returns nil on
 // success. Calling Stop() more than once returns the previous error or an
 // error indicating that the tracer has already been stopped.
 func (t *Trace) Stop() error {
-	if t.err != nil {
-		return t.err
-	}
+	t.cancel()
+	<-t.done
 
-	close(t.stop)
-	err := <-t.stopped
-	// TODO(fg) does the trace format support writing error messages? if yes,
-	// we should probably attempt to write the error to the file as well.
-	if finishErr := t.enc.Finish(); finishErr != nil && err == nil {
-		err = finishErr
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	if t.stopped && t.err == nil {
+		return errors.New("tracer is already stopped")
 	}
+	t.stopped = true
+	return t.err
+}
 
-	if err != nil {
-		t.err = err
-	} else {
-		// To be returned if Stop() is called more than once.
-		t.err = errors.New("tracer is already stopped")
+// encodeMeta encodes the metadata events that describe the trace
+// configuration to enc. The trigger is the reason for starting the trace or
+// taking the snapshot if it was done by a Watcher.
+func (t *Trace) encodeMeta(enc *internal.Encoder, trigger string) error {
+	if err := enc.CustomMeta("hz", t.c.Hz); err != nil {
+		return err
+	} else if t.c.OverheadBudget > 0 {
+		if err := enc.CustomMeta("overhead_budget", t.c.OverheadBudget); err != nil {
+			return err
+		}
+	}
+	if trigger != "" {
+		if err := enc.CustomMeta("trigger", trigger); err != nil {
+			return err
+		}
 	}
+	return enc.CustomMeta("state_frames", string(t.c.StateFrames))
+}
 
-	return err
+// newEncoder returns an encoder that writes traces in the format of c to w.
+func newEncoder(c Config, w io.Writer) (enc *internal.Encoder, err error) {
+	switch c.Format {
+	case FormatJSON:
+		enc, err = internal.NewEncoder(w)
+	case FormatPerfetto:
+		enc, err = internal.NewPerfettoEncoder(w)
+	case FormatPprof:
+		enc, err = internal.NewPprofEncoder(w)
+	default:
+		return nil, fmt.Errorf("unknown format: %q", c.Format)
+	}
+	if enc != nil {
+		enc.CallSites = c.CallSites
+	}
+	return enc, err
 }
 
 // trace is the background goroutine that takes goroutine profiles and
 // converts them to trace events.
-func (t *Trace) trace() error {
+func (t *Trace) trace(ctx context.Context, tick internal.Ticker) error {
 	var (
-		tick           = time.NewTicker(time.Second / time.Duration(t.c.Hz))
-		start          = time.Now()
-		now            = start
-		prevGoroutines = make(map[int]*gostackparse.Goroutine)
-		prof           goroutineProfiler
+		now        = t.startTime
+		tl         = newTimeline(t.enc, t.c.Hz)
+		hz         = t.c.Hz
+		ar         *adaptiveRate
+		encodeCost time.Duration // time spent encoding the previous sample
+		mr         *metricsReader
+		pr         *pauseReader
+		ov         *overhead
+		pending    []runtimeSlice // overhead slices for the next sample
 	)
+	if t.c.Metrics {
+		mr = newMetricsReader()
+	}
+	if t.c.GCPauses {
+		pr = newPauseReader()
+	}
+	if t.c.OverheadBudget > 0 {
+		ar = newAdaptiveRate(t.c.OverheadBudget, t.c.Hz)
+	}
+	if t.c.Overhead {
+		ov = &overhead{interval: time.Second / time.Duration(t.c.Hz), lastTick: t.startTime}
+	}
 	defer tick.Stop()
+	defer traces.remove(t)
 
 	for {
-		ts := now.Sub(start).Seconds() * 1e6
-		goroutines, err := prof.Goroutines()
+		s := &sample{ts: t.ts(now), slices: pending, annotations: t.user.take()}
+		pending = nil
+		start := t.clock.Now()
+		goroutines, err := t.c.Profiler.Goroutines()
 		if err != nil {
 			return err
 		}
-		if !t.c.IncludeSelf {
+		profiled := t.clock.Now()
+		if ar != nil {
+			// The time it takes to encode s is estimated by the time it took
+			// for the previous sample, so the rate change takes effect at s.
+			var changed bool
+			if hz, changed = ar.update(profiled.Sub(start) + encodeCost); changed {
+				interval := time.Second / time.Duration(hz)
+				tick.Reset(interval)
+				if ov != nil {
+					ov.interval, ov.lastTick = interval, profiled
+				}
+			}
+		}
+		s.hz = hz
+		if ov != nil {
+			ov.sample(profiled.Sub(start))
+			s.slices = append(s.slices, t.overheadSlice("Goroutines", start, profiled))
+		}
+		if mr != nil {
+			stw := profiled.Sub(start)
+			s.counters = append(mr.read(), counter{samplerSTWCounter, durationUs(stw)})
+		}
+		if pr != nil {
+			s.slices = append(s.slices, pr.read(t.startTime)...)
+		}
+		if t.tree != nil {
+			// The goroutines of the trace exist at the first sample, so they
+			// are never part of the tree, but its root may call fgtrace.
+			goroutines = t.tree.filter(goroutines)
+			s.annotations = t.tree.annotations(s.annotations)
+		} else if !t.c.IncludeSelf {
 			goroutines = excludeSelf(goroutines)
 		}
+		goroutines = filterGoroutines(goroutines, t.c.Include, t.c.Exclude)
 		addVirualStateFrames(goroutines, t.c.StateFrames)
-		currentGoroutines := make(map[int]*gostackparse.Goroutine, len(prevGoroutines))
-		for _, current := range goroutines {
-			currentGoroutines[current.ID] = current
-			prev := prevGoroutines[current.ID]
-			if err := t.enc.Encode(ts, prev, current); err != nil {
-				return err
-			}
+		s.goroutines = goroutines
+		if t.rec != nil {
+			t.rec.add(s)
+		} else if err := tl.add(s); err != nil {
+			return err
 		}
-		for _, prev := range prevGoroutines {
-			if _, ok := currentGoroutines[prev.ID]; ok {
-				continue
-			}
-			if err := t.enc.Encode(ts, prev, nil); err != nil {
+		encoded := t.clock.Now()
+		if r, ok := t.c.Dst.(*internal.RotatingFileWriter); ok && t.rec == nil && r.Due(encoded) {
+			if tl, err = t.rotate(r, tl, s); err != nil {
 				return err
 			}
 		}
-		prevGoroutines = currentGoroutines
+		if ov != nil {
+			// The time spent encoding s is only known now, so it's added to
+			// the next sample.
+			ov.encode += encoded.Sub(profiled)
+			pending = append(pending, t.overheadSlice("encode", profiled, encoded))
+		}
+		encodeCost = encoded.Sub(profiled)
 
 		// Sleep until next tick comes up or the tracer is stopped.
 		select {
-		case now = <-tick.C:
-		case <-t.stop:
-			ts := time.Since(start).Seconds() * 1e6
-			for _, prev := range prevGoroutines {
-				if err := t.enc.Encode(ts, prev, nil); err != nil {
-					return err
+		case now = <-tick.C():
+			if ov != nil {
+				ov.tick(now)
+			}
+		case <-ctx.Done():
+			traces.remove(t)
+			stopped := t.clock.Now()
+			ts := t.ts(stopped)
+			var importErr error
+			if t.imported != nil {
+				if importErr = <-t.imported; importErr != nil {
+					importErr = fmt.Errorf("execution trace: %w", importErr)
 				}
 			}
-			return nil
+			annotations := clip(t.user.take(), ts)
+			if t.tree != nil {
+				annotations = t.tree.annotations(annotations)
+			}
+			if t.rec != nil {
+				// The remaining user events are added as a sample without
+				// goroutines, which ends all stacks at ts like tl.end().
+				t.rec.add(&sample{ts: ts, hz: hz, annotations: annotations})
+				t.rec.stop(ts)
+				err = t.rec.encode(tl, ts)
+			} else if err = tl.annotate(annotations); err == nil {
+				err = tl.end(ts)
+			}
+			if err == nil && ov != nil {
+				err = t.encodeOverhead(ov, pending, stopped)
+			}
+			if err == nil {
+				err = importErr
+			}
+			return err
 		}
 	}
 }
 
-type goroutineProfiler struct {
-	buf []byte
+// rotate finishes the current file of r after s has been added to tl and
+// starts a new file that begins with the stacks of s. It returns the timeline
+// for the new file.
+func (t *Trace) rotate(r *internal.RotatingFileWriter, tl *timeline, s *sample) (*timeline, error) {
+	if err := tl.end(s.ts); err != nil {
+		return nil, err
+	} else if err := t.enc.Finish(); err != nil {
+		return nil, err
+	} else if err := r.Rotate(t.clock.Now()); err != nil {
+		return nil, err
+	}
+
+	enc, err := newEncoder(t.c, r)
+	if err != nil {
+		return nil, err
+	} else if err := t.encodeMeta(enc, t.c.trigger); err != nil {
+		return nil, err
+	}
+	t.enc = enc
+	next := newTimeline(enc, t.c.Hz)
+	// Only the stacks are carried over, the other events of s are already
+	// part of the previous file.
+	return next, next.add(&sample{ts: s.ts, hz: s.hz, goroutines: s.goroutines})
+}
+
+// overheadSlice returns a slice of the overhead track between start and end.
+func (t *Trace) overheadSlice(name string, start, end time.Time) runtimeSlice {
+	return runtimeSlice{
+		Track: internal.OverheadTrack,
+		Name:  name,
+		Ts:    t.ts(start),
+		Dur:   durationUs(end.Sub(start)),
+	}
 }
 
-func (g *goroutineProfiler) Goroutines() ([]*gostackparse.Goroutine, error) {
-	if g.buf == nil {
-		g.buf = make([]byte, 16*1024)
+// encodeOverhead encodes the overhead slices that were not part of a sample
+// as well as the time it took to end the trace, followed by the summary of ov
+// as the "overhead" metadata event.
+func (t *Trace) encodeOverhead(ov *overhead, slices []runtimeSlice, stopped time.Time) error {
+	ended := t.clock.Now()
+	ov.encode += ended.Sub(stopped)
+	slices = append(slices, t.overheadSlice("encode", stopped, ended))
+	for _, rs := range slices {
+		if err := t.enc.RuntimeSlice(rs.Track, rs.Ts, rs.Dur, rs.Name, rs.Args); err != nil {
+			return err
+		}
 	}
-	for {
-		n := runtime.Stack(g.buf, true)
-		if n < len(g.buf) {
-			gs, errs := gostackparse.Parse(bytes.NewReader(g.buf[:n]))
-			if len(errs) > 0 {
-				return gs, errs[0]
-			}
-			return gs, nil
+	return t.enc.CustomMeta("overhead", ov.summary(t.c.Hz, stopped.Sub(t.startTime)))
+}
+
+// annotate buffers a for the next sample. Annotations that started before the
+// trace are cut off at its start, the ones that ended before it are dropped.
+func (t *Trace) annotate(a Annotation) {
+	if a.End.Before(t.startTime) {
+		return
+	} else if a.Start.Before(t.startTime) {
+		a.Start = t.startTime
+	}
+	t.user.add(newUserEvent(a, t.startTime))
+}
+
+// ts returns the trace timestamp for now in microseconds.
+func (t *Trace) ts(now time.Time) float64 {
+	return now.Sub(t.startTime).Seconds() * 1e6
+}
+
+// sample holds the goroutines captured by a single tick of the trace loop.
+type sample struct {
+	ts          float64 // microseconds since the start of the trace
+	hz          int     // sampling rate from this sample on
+	goroutines  []*Goroutine
+	counters    []counter      // nil unless Config.Metrics is set
+	slices      []runtimeSlice // GC pauses and overhead since the previous sample
+	annotations []userEvent    // user events since the previous sample
+}
+
+// newTimeline returns a timeline that writes to enc. The rate of the samples
+// is expected to be hz, see Config.OverheadBudget.
+func newTimeline(enc *internal.Encoder, hz int) *timeline {
+	return &timeline{enc: enc, prev: make(map[int]*Goroutine), hz: hz}
+}
+
+// timeline converts a sequence of samples into trace events by diffing the
+// goroutines of each sample against the previous one.
+type timeline struct {
+	enc     *internal.Encoder
+	prev    map[int]*Goroutine
+	started bool // true after the first sample was added
+	hz      int  // sampling rate of the previous sample
+}
+
+// add encodes the events for s. Goroutines that appear after the first sample
+// are linked to their creator by a flow event if it's part of the trace.
+func (tl *timeline) add(s *sample) error {
+	if s.hz != tl.hz {
+		tl.hz = s.hz
+		if err := tl.enc.Instant(s.ts, "hz", map[string]interface{}{"hz": s.hz}); err != nil {
+			return err
+		}
+	}
+
+	var created []*Goroutine
+	current := make(map[int]*Goroutine, len(tl.prev))
+	for _, g := range s.goroutines {
+		current[g.ID] = g
+		prev := tl.prev[g.ID]
+		if err := tl.enc.Encode(s.ts, prev, g); err != nil {
+			return err
+		} else if prev == nil && tl.started && g.CreatedByID != 0 {
+			created = append(created, g)
+		}
+	}
+	for _, prev := range tl.prev {
+		if _, ok := current[prev.ID]; ok {
+			continue
+		}
+		if err := tl.enc.Encode(s.ts, prev, nil); err != nil {
+			return err
+		}
+	}
+	for _, g := range created {
+		if current[g.CreatedByID] == nil && tl.prev[g.CreatedByID] == nil {
+			continue
+		} else if err := tl.enc.Flow(s.ts, g.CreatedByID, g.ID); err != nil {
+			return err
+		}
+	}
+	for _, rs := range s.slices {
+		if err := tl.enc.RuntimeSlice(rs.Track, rs.Ts, rs.Dur, rs.Name, rs.Args); err != nil {
+			return err
+		}
+	}
+	for _, c := range s.counters {
+		if err := tl.enc.Counter(s.ts, c.Name, c.Value); err != nil {
+			return err
+		}
+	}
+	if err := tl.annotate(s.annotations); err != nil {
+		return err
+	}
+	tl.prev = current
+	tl.started = true
+	return nil
+}
+
+// annotate encodes the given user events.
+func (tl *timeline) annotate(events []userEvent) error {
+	for _, ev := range events {
+		var err error
+		switch ev.Kind {
+		case RegionAnnotation:
+			err = tl.enc.Region(ev.G, ev.Ts, ev.Dur, ev.Name, ev.Args)
+		case LogAnnotation:
+			err = tl.enc.Log(ev.G, ev.Ts, ev.Name, ev.Args)
+		case TaskAnnotation:
+			err = tl.enc.Task(ev.G, ev.ID, ev.Ts, ev.Dur, ev.Name, ev.Args)
+		case GCAnnotation:
+			err = tl.enc.RuntimeSlice(internal.GCCycleTrack, ev.Ts, ev.Dur, ev.Name, ev.Args)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// end encodes end events at ts for all stack frames that are still open.
+func (tl *timeline) end(ts float64) error {
+	for _, prev := range tl.prev {
+		if err := tl.enc.Encode(ts, prev, nil); err != nil {
+			return err
 		}
-		g.buf = make([]byte, 2*len(g.buf))
 	}
+	tl.prev = make(map[int]*Goroutine)
+	return nil
 }
 
-func excludeSelf(gs []*gostackparse.Goroutine) []*gostackparse.Goroutine {
-	newGS := make([]*gostackparse.Goroutine, 0, len(gs))
+func excludeSelf(gs []*Goroutine) []*Goroutine {
+	newGS := make([]*Goroutine, 0, len(gs))
 	for _, g := range gs {
 		include := true
 		for _, f := range g.Stack {
@@ -297,26 +943,34 @@ func excludeSelf(gs []*gostackparse.Goroutine) []*gostackparse.Goroutine {
 	return newGS
 }
 
-func addVirualStateFrames(gs []*gostackparse.Goroutine, f StateFrames) {
+func addVirualStateFrames(gs []*Goroutine, f StateFrames) {
 	if f == StateFramesNo {
 		return
 	}
 
 	for _, g := range gs {
 		state := g.State
-		if state == "runnable" {
+		if state == "" {
+			// The profiler doesn't know the state, see NewRecordProfiler().
+			continue
+		} else if state == "runnable" {
 			// Taking a goroutine profile puts all running goroutines into runnable
 			// state. So let's indicate that we can't be sure of their real state,
 			// but that it's most likely running instead of runnable.
 			state = "running/runnable"
 		}
+		addStateFrame(g, state, f)
+	}
+}
 
-		vFrame := &gostackparse.Frame{Func: state, File: "runtime", Line: 1}
-		switch f {
-		case StateFramesRoot:
-			g.Stack = append(g.Stack, vFrame)
-		case StateFramesLeaf:
-			g.Stack = append([]*gostackparse.Frame{vFrame}, g.Stack...)
-		}
+// addStateFrame adds state as a virtual frame to the stack of g according to
+// f.
+func addStateFrame(g *Goroutine, state string, f StateFrames) {
+	vFrame := &gostackparse.Frame{Func: state}
+	switch f {
+	case StateFramesRoot:
+		g.Stack = append(g.Stack, vFrame)
+	case StateFramesLeaf:
+		g.Stack = append([]*gostackparse.Frame{vFrame}, g.Stack...)
 	}
 }
@@ -2,17 +2,27 @@ package fgtrace
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/DataDog/gostackparse"
 	"github.com/felixge/fgtrace/internal"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
@@ -39,6 +49,13 @@ func ExampleConfig_Trace() {
 	defer Config{Dst: Writer(&buf)}.Trace().Stop()
 }
 
+func ExampleConfig_TraceContext() {
+	// Write trace until ctx is done or Stop() is called
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	defer Config{}.TraceContext(ctx).Stop()
+}
+
 func TestConfig(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -49,14 +66,23 @@ func TestConfig(t *testing.T) {
 			Dst:          File(defaultFile),
 			HTTPDuration: defaultHTTPDuration,
 			StateFrames:  defaultStateFrames,
+			Format:       defaultFormat,
+			Profiler:     NewStackProfiler(),
 			IncludeSelf:  false,
 		}, defaults)
 
+		perfetto := Config{Format: FormatPerfetto}.WithDefaults()
+		require.Equal(t, File(defaultPerfettoFile), perfetto.Dst)
+		pprof := Config{Format: FormatPprof}.WithDefaults()
+		require.Equal(t, File(defaultPprofFile), pprof.Dst)
+
 		noDefaults := Config{
 			Dst:          os.Stdout,
 			Hz:           23,
 			HTTPDuration: 42 * time.Second,
 			StateFrames:  StateFramesNo,
+			Format:       FormatPerfetto,
+			Profiler:     NewRecordProfiler(),
 			IncludeSelf:  true,
 		}
 		require.Equal(t, noDefaults, noDefaults.WithDefaults())
@@ -72,6 +98,349 @@ func TestConfig(t *testing.T) {
 			require.IsType(t, []interface{}{}, val)
 		})
 
+		t.Run("produces-perfetto", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			trace := Config{Dst: Writer(buf), Format: FormatPerfetto}.Trace()
+			require.NoError(t, trace.Stop())
+			// Every perfetto trace starts with a TracePacket (field 1, wire type 2).
+			require.NotEmpty(t, buf.Bytes())
+			require.Equal(t, byte(0x0a), buf.Bytes()[0])
+		})
+
+		t.Run("closes-dst", func(t *testing.T) {
+			dst := &closeRecorder{WriteCloser: Writer(&bytes.Buffer{})}
+			trace := Config{Dst: dst}.Trace()
+			require.False(t, dst.closed)
+			require.NoError(t, trace.Stop())
+			require.True(t, dst.closed)
+
+			// The trace is complete once it's closed.
+			name := filepath.Join(t.TempDir(), "fgtrace.json.gz")
+			require.NoError(t, Config{Dst: GzipFile(name)}.Trace().Stop())
+			f, err := os.Open(name)
+			require.NoError(t, err)
+			defer f.Close()
+			gz, err := gzip.NewReader(f)
+			require.NoError(t, err)
+			data, err := io.ReadAll(gz)
+			require.NoError(t, err)
+			_, err = internal.Unmarshal(data)
+			require.NoError(t, err)
+		})
+
+		t.Run("produces-pprof", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			trace := Config{Dst: Writer(buf), Format: FormatPprof}.Trace()
+			require.NoError(t, trace.Stop())
+			// pprof profiles are gzipped.
+			require.True(t, bytes.HasPrefix(buf.Bytes(), []byte{0x1f, 0x8b}))
+		})
+
+		t.Run("labels", func(t *testing.T) {
+			started, stop := make(chan struct{}), make(chan struct{})
+			defer close(stop)
+			go pprof.Do(context.Background(), pprof.Labels("request_id", "42"), func(context.Context) {
+				close(started)
+				<-stop
+			})
+			<-started
+			enableTracebackLabels(t)
+			buf := &bytes.Buffer{}
+			trace := Config{Dst: Writer(buf), IncludeSelf: true}.Trace()
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			labeled := data.Filter(func(e *internal.Event) bool {
+				labels, _ := e.Args["labels"].(map[string]interface{})
+				return labels["request_id"] == "42"
+			})
+			require.Greater(t, labeled.Len(), 0)
+		})
+
+		t.Run("unknown-format", func(t *testing.T) {
+			trace := Config{Dst: Writer(&bytes.Buffer{}), Format: "xml"}.Trace()
+			require.EqualError(t, trace.Stop(), `unknown format: "xml"`)
+		})
+
+		t.Run("FakeClock", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			clock := internal.NewFakeClock(time.Now())
+			conf := Config{
+				Dst:         Writer(buf),
+				Hz:          100,
+				IncludeSelf: true,
+				StateFrames: StateFramesNo,
+				Profiler: &scriptedProfiler{Script: [][]*Goroutine{
+					{newTestGoroutine(1, "running", "b", "a", "main")},
+					{newTestGoroutine(1, "running", "c", "a", "main"), newTestGoroutine(2, "chan receive", "worker")},
+					{newTestGoroutine(1, "sleep", "a", "main")},
+				}},
+				clock: clock,
+			}
+			trace := conf.Trace()
+			clock.Advance(10 * time.Millisecond)
+			clock.Advance(10 * time.Millisecond)
+			clock.Advance(5 * time.Millisecond)
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, []*internal.Event{
+				{Name: "hz", Ph: "M", Args: map[string]interface{}{"hz": float64(100)}},
+				{Name: "state_frames", Ph: "M", Args: map[string]interface{}{"state_frames": "no"}},
+				{Name: "process_name", Ph: "M", Pid: 1, Tid: 1, Args: map[string]interface{}{"name": "G1"}},
+				{Name: "main", Ph: "B", Ts: 0, Pid: 1, Tid: 1},
+				{Name: "a", Ph: "B", Ts: 0, Pid: 1, Tid: 1},
+				{Name: "b", Ph: "B", Ts: 0, Pid: 1, Tid: 1},
+				{Name: "b", Ph: "E", Ts: 10000, Pid: 1, Tid: 1},
+				{Name: "c", Ph: "B", Ts: 10000, Pid: 1, Tid: 1},
+				{Name: "process_name", Ph: "M", Pid: 2, Tid: 1, Args: map[string]interface{}{"name": "G2"}},
+				{Name: "worker", Ph: "B", Ts: 10000, Pid: 2, Tid: 1},
+				{Name: "c", Ph: "E", Ts: 20000, Pid: 1, Tid: 1},
+				{Name: "worker", Ph: "E", Ts: 20000, Pid: 2, Tid: 1},
+				{Name: "a", Ph: "E", Ts: 25000, Pid: 1, Tid: 1},
+				{Name: "main", Ph: "E", Ts: 25000, Pid: 1, Tid: 1},
+			}, data.Events)
+		})
+
+		t.Run("flows", func(t *testing.T) {
+			child := func(id, createdBy int, stack ...string) *Goroutine {
+				g := newTestGoroutine(id, "running", stack...)
+				g.CreatedByID = createdBy
+				return g
+			}
+			buf := &bytes.Buffer{}
+			clock := internal.NewFakeClock(time.Now())
+			conf := Config{
+				Dst:         Writer(buf),
+				Hz:          100,
+				IncludeSelf: true,
+				StateFrames: StateFramesNo,
+				Profiler: &scriptedProfiler{Script: [][]*Goroutine{
+					// G2 exists from the start, so its creation is not part of the trace.
+					{newTestGoroutine(1, "running", "main"), child(2, 1, "worker")},
+					// G4 was created by a goroutine that is not part of the trace.
+					{newTestGoroutine(1, "running", "main"), child(3, 1, "worker"), child(4, 99, "worker")},
+				}},
+				clock: clock,
+			}
+			trace := conf.Trace()
+			clock.Advance(10 * time.Millisecond)
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			flows := data.Filter(func(e *internal.Event) bool {
+				return e.Ph == "s" || e.Ph == "f"
+			})
+			require.Equal(t, []*internal.Event{
+				{Name: "go", Cat: "goroutine", Ph: "s", Ts: 10000, Pid: 1, Tid: 1, ID: 3},
+				{Name: "go", Cat: "goroutine", Ph: "f", Ts: 10000, Pid: 3, Tid: 1, ID: 3, Bp: "e"},
+			}, flows.Events)
+		})
+
+		t.Run("Metrics", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			clock := internal.NewFakeClock(time.Now())
+			conf := Config{
+				Dst:      Writer(buf),
+				Hz:       100,
+				Metrics:  true,
+				Profiler: &scriptedProfiler{Script: [][]*Goroutine{{newTestGoroutine(1, "running", "main")}}},
+				clock:    clock,
+			}
+			trace := conf.Trace()
+			clock.Advance(10 * time.Millisecond)
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			counters := map[string][]float64{}
+			for _, e := range data.Events {
+				if e.Ph == "C" {
+					counters[e.Name] = append(counters[e.Name], e.Args["value"].(float64))
+				}
+			}
+			// Older Go versions don't support all metrics, e.g. gomaxprocs was
+			// added in Go 1.20.
+			supported := map[string]bool{}
+			for _, d := range metrics.All() {
+				supported[d.Name] = true
+			}
+			for _, m := range runtimeMetrics {
+				want := 2
+				if !supported[m.Name] {
+					want = 0
+				} else if m.Counter == "sched_latency_p99_us" {
+					// The scheduler latency is reported for the time between
+					// samples.
+					want = 1
+				}
+				require.Len(t, counters[m.Counter], want, m.Counter)
+			}
+			require.Greater(t, counters["goroutines"][0], float64(0))
+			// The fake clock doesn't move while the goroutines are captured.
+			require.Equal(t, []float64{0, 0}, counters["sampler_stw_us"])
+		})
+
+		t.Run("GCPauses", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			trace := Config{Dst: Writer(buf), GCPauses: true}.Trace()
+			runtime.GC()
+			time.Sleep(50 * time.Millisecond)
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			runtimeEvents := data.Filter(func(e *internal.Event) bool {
+				return e.Pid == internal.RuntimePid && e.Tid == 1
+			})
+			require.GreaterOrEqual(t, runtimeEvents.Len(), 3)
+			require.Equal(t, &internal.Event{Name: "process_name", Ph: "M", Tid: 1, Args: map[string]interface{}{"name": "runtime"}}, runtimeEvents.Events[0])
+			require.Equal(t, &internal.Event{Name: "thread_name", Ph: "M", Tid: 1, Args: map[string]interface{}{"name": "GC"}}, runtimeEvents.Events[1])
+			for _, e := range runtimeEvents.Events[2:] {
+				require.Equal(t, "X", e.Ph)
+				require.Equal(t, "GC pause", e.Name)
+				require.Greater(t, e.Ts, float64(0))
+				require.Greater(t, e.Args["gc"], float64(0))
+			}
+		})
+
+		t.Run("Overhead", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			clock := internal.NewFakeClock(time.Now())
+			conf := Config{
+				Dst:      Writer(buf),
+				Hz:       100,
+				Overhead: true,
+				Profiler: &scriptedProfiler{Script: [][]*Goroutine{{newTestGoroutine(1, "running", "main")}}},
+				clock:    clock,
+			}
+			trace := conf.Trace()
+			clock.Advance(10 * time.Millisecond)
+			clock.Advance(10 * time.Millisecond)
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			slices := map[string]int{}
+			var summary map[string]interface{}
+			for _, e := range data.Events {
+				if e.Ph == "X" && e.Tid == int64(internal.OverheadTrack) {
+					slices[e.Name]++
+				} else if e.Ph == "M" && e.Name == "overhead" {
+					summary = e.Args["overhead"].(map[string]interface{})
+				}
+			}
+			require.Equal(t, map[string]int{"Goroutines": 3, "encode": 4}, slices)
+			require.Equal(t, map[string]interface{}{
+				"samples":        float64(3),
+				"sampler_us":     float64(0),
+				"max_sampler_us": float64(0),
+				"encode_us":      float64(0),
+				"hz":             float64(100),
+				"achieved_hz":    float64(100),
+				"missed_ticks":   float64(0),
+			}, summary)
+		})
+
+		t.Run("OverheadBudget", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			// No profiler can capture the goroutines in less than a ns.
+			conf := Config{Dst: Writer(buf), Hz: 100, OverheadBudget: 1e-9}
+			trace := conf.Trace()
+			time.Sleep(100 * time.Millisecond)
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, 100, data.MetaHz())
+			changes := data.Filter(func(e *internal.Event) bool {
+				return e.Ph == "i" && e.Name == "hz"
+			})
+			require.Equal(t, []*internal.Event{
+				{Name: "hz", Ph: "i", S: "g", Ts: 0, Args: map[string]interface{}{"hz": float64(1)}},
+			}, changes.Events[:1])
+			budget := data.Filter(func(e *internal.Event) bool {
+				return e.Ph == "M" && e.Name == "overhead_budget"
+			})
+			require.Equal(t, 1, budget.Len())
+		})
+
+		t.Run("RotatingFile", func(t *testing.T) {
+			dir := t.TempDir()
+			clock := internal.NewFakeClock(time.Now())
+			conf := Config{
+				Dst:         RotatingFile(filepath.Join(dir, "fgtrace.json"), Rotation{Interval: 20 * time.Millisecond, MaxFiles: 2}),
+				Hz:          100,
+				IncludeSelf: true,
+				StateFrames: StateFramesNo,
+				Profiler: &scriptedProfiler{Script: [][]*Goroutine{
+					{newTestGoroutine(1, "running", "a", "main")},
+					{newTestGoroutine(1, "running", "b", "main")},
+				}},
+				clock: clock,
+			}
+			trace := conf.Trace()
+			for i := 0; i < 5; i++ {
+				clock.Advance(10 * time.Millisecond)
+			}
+			require.NoError(t, trace.Stop())
+
+			// The files start at 0ms, 20ms and 40ms, the first one was removed.
+			names, err := filepath.Glob(filepath.Join(dir, "*"))
+			require.NoError(t, err)
+			require.Equal(t, []string{
+				filepath.Join(dir, "fgtrace-000002.json"),
+				filepath.Join(dir, "fgtrace-000003.json"),
+			}, names)
+
+			data, err := os.ReadFile(names[0])
+			require.NoError(t, err)
+			td, err := internal.Unmarshal(data)
+			require.NoError(t, err)
+			require.Equal(t, 100, td.MetaHz())
+			require.Equal(t, []*internal.Event{
+				{Name: "process_name", Ph: "M", Pid: 1, Tid: 1, Args: map[string]interface{}{"name": "G1"}},
+				{Name: "main", Ph: "B", Ts: 20000, Pid: 1, Tid: 1},
+				{Name: "b", Ph: "B", Ts: 20000, Pid: 1, Tid: 1},
+				{Name: "b", Ph: "E", Ts: 40000, Pid: 1, Tid: 1},
+				{Name: "main", Ph: "E", Ts: 40000, Pid: 1, Tid: 1},
+			}, td.Filter(func(e *internal.Event) bool { return e.Pid == 1 }).Events)
+		})
+
+		t.Run("GzipFile", func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "fgtrace.json.gz")
+			conf := Config{Dst: GzipFile(name), Hz: 100}
+			trace := conf.Trace()
+			time.Sleep(50 * time.Millisecond)
+			require.NoError(t, trace.Stop())
+
+			f, err := os.Open(name)
+			require.NoError(t, err)
+			defer f.Close()
+			gr, err := gzip.NewReader(f)
+			require.NoError(t, err)
+			data, err := io.ReadAll(gr)
+			require.NoError(t, err)
+			td, err := internal.Unmarshal(data)
+			require.NoError(t, err)
+			require.Equal(t, 100, td.MetaHz())
+		})
+
+		t.Run("TraceContext", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			ctx, cancel := context.WithCancel(context.Background())
+			trace := Config{Dst: Writer(buf)}.TraceContext(ctx)
+			cancel()
+			<-trace.done
+			var val interface{}
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &val))
+			require.NoError(t, trace.Stop())
+			require.EqualError(t, trace.Stop(), "tracer is already stopped")
+		})
+
 		t.Run("stop-returns-error", func(t *testing.T) {
 			ew := internal.ErrWriter{Err: errors.New("whups")}
 			trace := Config{Dst: Writer(ew)}.Trace()
@@ -79,47 +448,199 @@ func TestConfig(t *testing.T) {
 		})
 
 		t.Run("Hz", func(t *testing.T) {
-			testHz := func(t *testing.T, hz, attempt int) bool {
-				testDt := time.Duration(math.Pow(2, float64(attempt)) * float64(time.Second/10))
-				buf := &bytes.Buffer{}
-				conf := Config{
-					Dst:         Writer(buf),
-					Hz:          hz,
-					IncludeSelf: true,
-				}
-				trace := conf.Trace()
-				workloadSimulator(hz, testDt)
-				require.NoError(t, trace.Stop())
-				data, err := internal.Unmarshal(buf.Bytes())
-				require.NoError(t, err)
-				require.Equal(t, conf.Hz, data.MetaHz())
-				callCount := data.Filter(func(e *internal.Event) bool {
-					return e.Ph == "B" &&
-						(strings.HasSuffix(e.Name, "fgtrace.workloadA") ||
-							strings.HasSuffix(e.Name, "fgtrace.workloadB"))
-				}).Len()
-				wantCount := int(float64(hz) / (float64(time.Second) / float64(testDt)))
-				wantEpsilon := 0.3
-				if attempt < 7 {
-					epsilon := math.Abs(float64(wantCount-callCount)) / math.Abs(float64(wantCount))
-					return epsilon <= wantEpsilon
-				} else {
-					require.InEpsilon(t, wantCount, callCount, wantEpsilon)
-					return true
-				}
-			}
-
 			for _, hz := range []int{10, 100, 200} {
 				t.Run(fmt.Sprintf("%d", hz), func(t *testing.T) {
-					for attempt := 0; ; attempt++ {
-						if testHz(t, hz, attempt) {
-							return
+					// Every sample alternates between workloadA and workloadB, so
+					// each sample begins a new slice.
+					var script [][]*Goroutine
+					for i := 0; i <= hz; i++ {
+						fn := "workloadA"
+						if i%2 == 1 {
+							fn = "workloadB"
 						}
+						script = append(script, []*Goroutine{newTestGoroutine(1, "running", fn, "main")})
 					}
+					buf := &bytes.Buffer{}
+					clock := internal.NewFakeClock(time.Now())
+					profiler := &scriptedProfiler{Script: script}
+					conf := Config{
+						Dst:         Writer(buf),
+						Hz:          hz,
+						IncludeSelf: true,
+						StateFrames: StateFramesNo,
+						Profiler:    profiler,
+						clock:       clock,
+					}
+					trace := conf.Trace()
+					clock.Advance(time.Second)
+					require.NoError(t, trace.Stop())
+
+					data, err := internal.Unmarshal(buf.Bytes())
+					require.NoError(t, err)
+					require.Equal(t, conf.Hz, data.MetaHz())
+					require.Equal(t, hz+1, profiler.calls)
+					callCount := data.Filter(func(e *internal.Event) bool {
+						return e.Ph == "B" && strings.HasPrefix(e.Name, "workload")
+					}).Len()
+					require.Equal(t, hz+1, callCount)
 				})
 			}
 		})
 
+		t.Run("Hz-real", func(t *testing.T) {
+			// A smoke test of sampling the real goroutines with the real clock.
+			// The bounds are loose as the scheduling of the workload and the
+			// samples is up to the machine.
+			hz, dt := 100, 500*time.Millisecond
+			buf := &bytes.Buffer{}
+			conf := Config{Dst: Writer(buf), Hz: hz, IncludeSelf: true}
+			trace := conf.Trace()
+			workloadSimulator(hz, dt)
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, hz, data.MetaHz())
+			callCount := data.Filter(func(e *internal.Event) bool {
+				return e.Ph == "B" &&
+					(strings.HasSuffix(e.Name, "fgtrace.workloadA") ||
+						strings.HasSuffix(e.Name, "fgtrace.workloadB"))
+			}).Len()
+			wantCount := int(float64(hz) * dt.Seconds())
+			require.Greater(t, callCount, wantCount/5)
+			require.LessOrEqual(t, callCount, 2*wantCount)
+		})
+
+		t.Run("Window", func(t *testing.T) {
+			window := 100 * time.Millisecond
+			buf := &bytes.Buffer{}
+			conf := Config{Dst: Writer(buf), Window: window}.WithDefaults()
+			trace := conf.Trace()
+			workloadSimulator(conf.Hz, 3*window)
+
+			snapshot := &bytes.Buffer{}
+			require.NoError(t, trace.Snapshot(snapshot))
+			require.NoError(t, trace.Stop())
+
+			for _, data := range [][]byte{snapshot.Bytes(), buf.Bytes()} {
+				td, err := internal.Unmarshal(data)
+				require.NoError(t, err)
+				require.Equal(t, conf.Hz, td.MetaHz())
+				var begins, ends int
+				minTs, maxTs := math.Inf(1), math.Inf(-1)
+				for _, e := range td.Events {
+					switch e.Ph {
+					case "B":
+						begins++
+					case "E":
+						ends++
+					default:
+						continue
+					}
+					minTs = math.Min(minTs, e.Ts)
+					maxTs = math.Max(maxTs, e.Ts)
+				}
+				require.Greater(t, begins, 0)
+				require.Equal(t, begins, ends)
+				require.InDelta(t, window.Microseconds(), maxTs-minTs, float64(window.Microseconds())/2)
+				require.Greater(t, minTs, float64(window.Microseconds()))
+			}
+
+			noWindow := Config{Dst: Writer(&bytes.Buffer{})}.Trace()
+			require.Error(t, noWindow.Snapshot(&bytes.Buffer{}))
+			require.NoError(t, noWindow.Stop())
+		})
+
+		t.Run("WindowBytes", func(t *testing.T) {
+			r := &recorder{maxBytes: 1}
+			for i := 1; i <= 3; i++ {
+				r.add(&sample{ts: float64(i)})
+			}
+			require.Len(t, r.samples, 3)
+
+			s := &sample{ts: 4, goroutines: []*Goroutine{{Goroutine: gostackparse.Goroutine{ID: 1}}}}
+			r.add(s)
+			require.Equal(t, []*sample{s}, r.samples)
+		})
+
+		t.Run("Include", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			conf := Config{
+				Dst:         Writer(buf),
+				IncludeSelf: true,
+				Include:     Filter{Func: regexp.MustCompile(`fgtrace\.workloadSimulator$`)},
+			}.WithDefaults()
+			trace := conf.Trace()
+			workloadSimulator(conf.Hz, time.Second/10)
+			require.NoError(t, trace.Stop())
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			processes := data.Filter(func(e *internal.Event) bool {
+				return e.Name == "process_name"
+			})
+			require.Equal(t, 1, processes.Len())
+		})
+
+		t.Run("CallerTree", func(t *testing.T) {
+			requireCreatorIDs(t)
+			// An unrelated goroutine that exists before the trace starts and
+			// annotates while it's running.
+			unrelated, annotate, done := make(chan int), make(chan struct{}), make(chan struct{})
+			go func() {
+				unrelated <- curGoroutineID()
+				<-annotate
+				Region(context.Background(), "unrelated")()
+				close(done)
+			}()
+			unrelatedID := <-unrelated
+
+			buf := &bytes.Buffer{}
+			trace := Config{Dst: Writer(buf), Hz: 1000, CallerTree: true}.Trace()
+			close(annotate)
+			<-done
+			ids := make(chan int, 2)
+			go func() {
+				ids <- curGoroutineID()
+				time.Sleep(10 * time.Millisecond)
+				// The grandchild outlives its creator.
+				go func() {
+					defer close(ids)
+					ids <- curGoroutineID()
+					time.Sleep(10 * time.Millisecond)
+				}()
+			}()
+			Region(context.Background(), "caller")()
+			want := map[int]bool{curGoroutineID(): true}
+			for id := range ids {
+				want[id] = true
+			}
+			require.NoError(t, trace.Stop())
+
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			pids := map[int]bool{}
+			var regions []string
+			for _, e := range data.Events {
+				if e.Ph == "B" {
+					pids[int(e.Pid)] = true
+				} else if e.Ph == "X" {
+					regions = append(regions, e.Name)
+				}
+			}
+			require.Equal(t, want, pids)
+			require.False(t, pids[unrelatedID])
+			require.Equal(t, []string{"caller"}, regions)
+		})
+
+		t.Run("CallerTree-RecordProfiler", func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			trace := Config{Dst: Writer(buf), CallerTree: true, Profiler: NewRecordProfiler()}.Trace()
+			err := trace.Stop()
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "CallerTree requires")
+			require.Zero(t, buf.Len())
+		})
+
 		t.Run("IncludeSelf", func(t *testing.T) {
 			test := func(t *testing.T, includeSelf bool) int {
 				buf := &bytes.Buffer{}
@@ -210,9 +731,181 @@ func TestConfig(t *testing.T) {
 			require.Equal(t, hz, data.MetaHz())
 		})
 
+		t.Run("canceled", func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/?seconds=10", nil).WithContext(ctx)
+			start := time.Now()
+			Config{}.ServeHTTP(rr, r)
+			require.Less(t, time.Since(start), 5*time.Second)
+			var val interface{}
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &val))
+		})
+
+		t.Run("start-error", func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			start := time.Now()
+			Config{Format: "foo"}.ServeHTTP(rr, r)
+			require.Less(t, time.Since(start), 5*time.Second)
+			require.Equal(t, http.StatusInternalServerError, rr.Code)
+			require.Empty(t, rr.Header().Get("Content-Encoding"))
+			require.Equal(t, "failed to start trace: unknown format: \"foo\"\n", rr.Body.String())
+		})
+
+		t.Run("filters", func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/?seconds=0.1&include_package=testing&include_package=runtime&exclude_state=running", nil)
+			packages := make([]string, 0, 10)
+			Config{Include: Filter{Packages: packages}}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusOK, rr.Code)
+			// the handler must not modify the config it was created from
+			require.Equal(t, []string{"", ""}, packages[:2])
+
+			rr = httptest.NewRecorder()
+			r = httptest.NewRequest("GET", "/?include_func=(", nil)
+			Config{}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+		})
+
+		t.Run("call_sites", func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/?call_sites=true&seconds=0.1", nil)
+			Config{IncludeSelf: true}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusOK, rr.Code)
+			data, err := internal.Unmarshal(rr.Body.Bytes())
+			require.NoError(t, err)
+			withFile := data.Filter(func(e *internal.Event) bool {
+				return e.Ph == "B" && e.Args["file"] != nil && e.Args["line"] != nil
+			})
+			require.Greater(t, withFile.Len(), 0)
+
+			rr = httptest.NewRecorder()
+			r = httptest.NewRequest("GET", "/?call_sites=maybe", nil)
+			Config{}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+		})
+
+		t.Run("metrics", func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/?metrics=true&seconds=0.1", nil)
+			Config{}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusOK, rr.Code)
+			data, err := internal.Unmarshal(rr.Body.Bytes())
+			require.NoError(t, err)
+			goroutines := data.Filter(func(e *internal.Event) bool {
+				return e.Ph == "C" && e.Name == "goroutines"
+			})
+			require.Greater(t, goroutines.Len(), 0)
+
+			rr = httptest.NewRecorder()
+			r = httptest.NewRequest("GET", "/?metrics=maybe", nil)
+			Config{}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+		})
+
+		t.Run("overhead_budget", func(t *testing.T) {
+			for _, val := range []string{"0", "1.5", "x"} {
+				rr := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "/?overhead_budget="+val, nil)
+				Config{}.ServeHTTP(rr, r)
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			}
+		})
+
+		t.Run("Accept-Encoding", func(t *testing.T) {
+			for _, c := range []struct {
+				Format         string
+				AcceptEncoding string
+				WantGzip       bool
+			}{
+				{"json", "", false},
+				{"json", "gzip, deflate", true},
+				{"json", "br;q=1.0, GZIP;q=0.5", true},
+				{"json", "gzip;q=0", false},
+				{"json", "*", true},
+				{"perfetto", "gzip", true},
+				{"pprof", "gzip", false},
+			} {
+				rr := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "/?seconds=0.05&format="+c.Format, nil)
+				r.Header.Set("Accept-Encoding", c.AcceptEncoding)
+				Config{}.ServeHTTP(rr, r)
+				require.Equal(t, http.StatusOK, rr.Code)
+
+				body := rr.Body.Bytes()
+				if c.WantGzip {
+					require.Equal(t, "gzip", rr.Header().Get("Content-Encoding"), c.AcceptEncoding)
+					gr, err := gzip.NewReader(rr.Body)
+					require.NoError(t, err)
+					body, err = io.ReadAll(gr)
+					require.NoError(t, err)
+				} else {
+					require.Equal(t, "", rr.Header().Get("Content-Encoding"), c.AcceptEncoding)
+				}
+				if c.Format == "json" {
+					_, err := internal.Unmarshal(body)
+					require.NoError(t, err)
+				}
+			}
+		})
+
+		t.Run("format", func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/?format=perfetto&seconds=0.1", nil)
+			Config{}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.Equal(t, byte(0x0a), rr.Body.Bytes()[0])
+
+			rr = httptest.NewRecorder()
+			r = httptest.NewRequest("GET", "/?format=xml", nil)
+			Config{}.ServeHTTP(rr, r)
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+		})
+
 	})
 }
 
+// scriptedProfiler is a Profiler that returns the goroutines of the next
+// element of Script for every call, repeating the last one once the Script is
+// exhausted. It returns copies, so the Script is not modified by the trace.
+type scriptedProfiler struct {
+	Script [][]*Goroutine
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *scriptedProfiler) Goroutines() ([]*Goroutine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := p.calls
+	if i >= len(p.Script) {
+		i = len(p.Script) - 1
+	}
+	p.calls++
+	gs := make([]*Goroutine, len(p.Script[i]))
+	for j, g := range p.Script[i] {
+		copied := *g
+		copied.Stack = append([]*gostackparse.Frame(nil), g.Stack...)
+		gs[j] = &copied
+	}
+	return gs, nil
+}
+
+// newTestGoroutine returns a goroutine with the given id, state and stack
+// frames ordered from leaf to root.
+func newTestGoroutine(id int, state string, stack ...string) *Goroutine {
+	g := &Goroutine{Goroutine: gostackparse.Goroutine{ID: id, State: state}}
+	for _, fn := range stack {
+		g.Stack = append(g.Stack, &gostackparse.Frame{Func: fn})
+	}
+	return g
+}
+
 // workloadSimulator calls workloadA followed by workloadB in a loop. Each call
 // takes 1/sampleHz to complete, so the effective frequency of the whole loop
 // is sampleHz/2 which is the [nyquist frequency] of sampleHz, i.e. the highest
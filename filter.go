@@ -0,0 +1,124 @@
+package fgtrace
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Filter selects goroutines for Config.Include and Config.Exclude. A goroutine
+// matches a filter if it satisfies all of its non-zero fields.
+type Filter struct {
+	// Func matches goroutines with at least one stack frame whose function
+	// name matches the regular expression, e.g. `^net/http\.`.
+	Func *regexp.Regexp
+	// Packages matches goroutines with at least one stack frame belonging to
+	// one of the given packages or their sub packages, e.g. "net" matches
+	// functions in "net" as well as "net/http".
+	Packages []string
+	// States matches goroutines in one of the given states as reported by
+	// runtime.Stack(), e.g. "select" or "chan receive".
+	States []string
+	// CreatedBy matches goroutines whose creator function name matches the
+	// regular expression.
+	CreatedBy *regexp.Regexp
+}
+
+// isZero returns true if f has no criteria set.
+func (f Filter) isZero() bool {
+	return f.Func == nil && len(f.Packages) == 0 && len(f.States) == 0 && f.CreatedBy == nil
+}
+
+// match returns true if g satisfies all criteria of f. A zero Filter matches
+// all goroutines.
+func (f Filter) match(g *Goroutine) bool {
+	if len(f.States) > 0 && !containsString(f.States, g.State) {
+		return false
+	}
+	if f.CreatedBy != nil && (g.CreatedBy == nil || !f.CreatedBy.MatchString(g.CreatedBy.Func)) {
+		return false
+	}
+	if f.Func != nil && !anyFrame(g, func(fn string) bool { return f.Func.MatchString(fn) }) {
+		return false
+	}
+	if len(f.Packages) > 0 && !anyFrame(g, func(fn string) bool {
+		pkg := funcPackage(fn)
+		for _, p := range f.Packages {
+			if pkg == p || strings.HasPrefix(pkg, p+"/") {
+				return true
+			}
+		}
+		return false
+	}) {
+		return false
+	}
+	return true
+}
+
+// filterGoroutines returns the goroutines of gs that match include and don't
+// match exclude. A zero include matches all goroutines, a zero exclude none.
+func filterGoroutines(gs []*Goroutine, include, exclude Filter) []*Goroutine {
+	if include.isZero() && exclude.isZero() {
+		return gs
+	}
+	newGS := make([]*Goroutine, 0, len(gs))
+	for _, g := range gs {
+		if include.match(g) && (exclude.isZero() || !exclude.match(g)) {
+			newGS = append(newGS, g)
+		}
+	}
+	return newGS
+}
+
+// anyFrame returns true if fn returns true for the function name of any stack
+// frame of g.
+func anyFrame(g *Goroutine, fn func(string) bool) bool {
+	for _, f := range g.Stack {
+		if fn(f.Func) {
+			return true
+		}
+	}
+	return false
+}
+
+// funcPackage returns the package import path of the given function name,
+// e.g. "net/http" for "net/http.(*Server).Serve". The runtime escapes the dots
+// in the last element of the path, e.g. "gopkg.in/yaml%2ev3.Unmarshal", which
+// are unescaped. Unescaped names are supported for versioned elements, e.g.
+// "gopkg.in/yaml.v3.Unmarshal".
+func funcPackage(fn string) string {
+	slash := strings.LastIndexByte(fn, '/')
+	pkg := fn
+	if dot := strings.IndexByte(fn[slash+1:], '.'); dot >= 0 {
+		end := slash + 1 + dot
+		for n := versionLen(fn[end+1:]); n > 0; n = versionLen(fn[end+1:]) {
+			end += 1 + n
+		}
+		pkg = fn[:end]
+	}
+	return strings.ReplaceAll(pkg, "%2e", ".")
+}
+
+// versionLen returns the length of the major version element at the start of
+// s if it is followed by a dot, e.g. 2 for "v3.Unmarshal", or 0.
+func versionLen(s string) int {
+	if len(s) < 2 || s[0] != 'v' {
+		return 0
+	}
+	i := 1
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 1 || i == len(s) || s[i] != '.' {
+		return 0
+	}
+	return i
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package fgtrace
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DataDog/gostackparse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	worker := &Goroutine{Goroutine: gostackparse.Goroutine{
+		ID:        2,
+		State:     "chan receive",
+		CreatedBy: &gostackparse.Frame{Func: "main.startWorkers"},
+		Stack: []*gostackparse.Frame{
+			{Func: "net/http.(*Client).Do"},
+			{Func: "main.worker"},
+		},
+	}}
+	mainG := &Goroutine{Goroutine: gostackparse.Goroutine{
+		ID:    1,
+		State: "running",
+		Stack: []*gostackparse.Frame{{Func: "main.main"}},
+	}}
+
+	tests := []struct {
+		Name   string
+		Filter Filter
+		Want   []bool // match result for worker and mainG
+	}{
+		{"zero", Filter{}, []bool{true, true}},
+		{"func", Filter{Func: regexp.MustCompile(`^main\.worker$`)}, []bool{true, false}},
+		{"package", Filter{Packages: []string{"net"}}, []bool{true, false}},
+		{"package-prefix", Filter{Packages: []string{"ne"}}, []bool{false, false}},
+		{"package-main", Filter{Packages: []string{"main"}}, []bool{true, true}},
+		{"state", Filter{States: []string{"running", "select"}}, []bool{false, true}},
+		{"created-by", Filter{CreatedBy: regexp.MustCompile(`Workers`)}, []bool{true, false}},
+		{"all", Filter{Packages: []string{"main"}, States: []string{"running"}}, []bool{false, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			require.Equal(t, test.Want, []bool{test.Filter.match(worker), test.Filter.match(mainG)})
+		})
+	}
+
+	t.Run("filterGoroutines", func(t *testing.T) {
+		gs := []*Goroutine{worker, mainG}
+		require.Equal(t, gs, filterGoroutines(gs, Filter{}, Filter{}))
+		require.Equal(t, []*Goroutine{mainG}, filterGoroutines(gs, Filter{}, Filter{Packages: []string{"net"}}))
+		require.Equal(t, []*Goroutine{worker}, filterGoroutines(gs, Filter{Packages: []string{"main"}}, Filter{States: []string{"running"}}))
+	})
+}
+
+func Test_funcPackage(t *testing.T) {
+	require.Equal(t, "main", funcPackage("main.main"))
+	require.Equal(t, "net/http", funcPackage("net/http.(*Server).Serve"))
+	require.Equal(t, "github.com/felixge/fgtrace", funcPackage("github.com/felixge/fgtrace.(*Trace).trace.func1"))
+	require.Equal(t, "gopkg.in/yaml.v3", funcPackage("gopkg.in/yaml%2ev3.Unmarshal"))
+	require.Equal(t, "gopkg.in/yaml.v3", funcPackage("gopkg.in/yaml.v3.Unmarshal"))
+	require.Equal(t, "gopkg.in/yaml.v3", funcPackage("gopkg.in/yaml.v3.(*decoder).unmarshal.func1"))
+	require.Equal(t, "example.com/a.b", funcPackage("example.com/a%2eb.F"))
+	require.Equal(t, "main", funcPackage("main.v2"))
+}
@@ -0,0 +1,55 @@
+package fgtrace
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/felixge/fgtrace/internal"
+)
+
+// newPauseReader returns a pauseReader that reports the pauses of the GC
+// cycles that finish after it was created.
+func newPauseReader() *pauseReader {
+	r := &pauseReader{}
+	debug.ReadGCStats(&r.stats)
+	r.numGC = r.stats.NumGC
+	return r
+}
+
+// pauseReader reads the GC pause history of the runtime. The history only
+// contains the stop-the-world pauses, not the start and end of GC cycles,
+// which are only reported by execution traces, see GCAnnotation.
+type pauseReader struct {
+	stats debug.GCStats
+	numGC int64 // number of GC cycles at the time of the last read
+}
+
+// read returns the pauses of the GC cycles that finished since the last read
+// as slices of the GC track, oldest first, with timestamps relative to start.
+// The runtime only remembers the most recent 256 pauses, so older ones are
+// lost if more cycles finish between two reads.
+func (r *pauseReader) read(start time.Time) []runtimeSlice {
+	debug.ReadGCStats(&r.stats)
+	n := r.stats.NumGC - r.numGC
+	if n > int64(len(r.stats.Pause)) {
+		n = int64(len(r.stats.Pause))
+	}
+	r.numGC = r.stats.NumGC
+	if n <= 0 {
+		return nil
+	}
+	pauses := make([]runtimeSlice, n)
+	for i := range pauses {
+		// The pause history is ordered from newest to oldest.
+		j := int(n) - i - 1
+		d := r.stats.Pause[j]
+		pauses[i] = runtimeSlice{
+			Track: internal.GCTrack,
+			Name:  "GC pause",
+			Ts:    r.stats.PauseEnd[j].Add(-d).Sub(start).Seconds() * 1e6,
+			Dur:   d.Seconds() * 1e6,
+			Args:  map[string]interface{}{"gc": r.stats.NumGC - int64(j)},
+		}
+	}
+	return pauses
+}
@@ -0,0 +1,92 @@
+package fgtrace
+
+import "time"
+
+// Import applies WithDefaults to c and returns an Importer that writes a trace
+// to c.Dst in c.Format. The timestamps passed to the Importer are relative to
+// start, which becomes the start of the trace. Unlike Trace(), it doesn't
+// capture any goroutines itself and writes no "hz" metadata, since the
+// imported trace has no sample rate. Dst is not closed if an error is
+// returned.
+func (c Config) Import(start time.Time) (*Importer, error) {
+	c = c.WithDefaults()
+	enc, err := newEncoder(c, c.Dst)
+	if err != nil {
+		return nil, err
+	} else if err := enc.CustomMeta("state_frames", string(c.StateFrames)); err != nil {
+		return nil, err
+	}
+	return &Importer{c: c, tl: newTimeline(enc, 0), start: start}, nil
+}
+
+// Importer writes a trace of goroutines that were recorded outside of fgtrace,
+// e.g. the github.com/felixge/fgtrace/exectrace module uses it to convert Go
+// execution traces. Instead of sampling all goroutines, the caller reports
+// every change of a goroutine's state or stack. An Importer must not be used
+// concurrently.
+type Importer struct {
+	c     Config
+	tl    *timeline
+	start time.Time
+}
+
+// Goroutine records that g has its state and stack from t on. The stack is
+// ordered from leaf to root frame, and the Importer takes ownership of g. The
+// state is added as a virtual frame according to Config.StateFrames, and g is
+// filtered by Config.Include and Config.Exclude: if it doesn't match them, the
+// stack it had before is ended instead. If created is true, g was created at t
+// and is linked to the goroutine with the id g.CreatedByID by a flow event if
+// that one is part of the trace.
+func (im *Importer) Goroutine(t time.Time, g *Goroutine, created bool) error {
+	ts := im.ts(t)
+	prev := im.tl.prev[g.ID]
+	if len(filterGoroutines([]*Goroutine{g}, im.c.Include, im.c.Exclude)) == 0 {
+		return im.Exit(t, g.ID)
+	}
+	if g.State != "" {
+		addStateFrame(g, g.State, im.c.StateFrames)
+	}
+	if err := im.tl.enc.Encode(ts, prev, g); err != nil {
+		return err
+	}
+	im.tl.prev[g.ID] = g
+	if created && im.tl.prev[g.CreatedByID] != nil {
+		return im.tl.enc.Flow(ts, g.CreatedByID, g.ID)
+	}
+	return nil
+}
+
+// Exit ends the stack of the goroutine with the given id at t, e.g. because it
+// exited. It does nothing if the goroutine is not part of the trace.
+func (im *Importer) Exit(t time.Time, id int) error {
+	prev, ok := im.tl.prev[id]
+	if !ok {
+		return nil
+	}
+	delete(im.tl.prev, id)
+	return im.tl.enc.Encode(im.ts(t), prev, nil)
+}
+
+// Annotate writes a to the annotation track of its goroutine, see
+// Config.ExecutionTrace.
+func (im *Importer) Annotate(a Annotation) error {
+	return im.tl.annotate([]userEvent{newUserEvent(a, im.start)})
+}
+
+// Finish ends the stacks of all goroutines at end, finishes the trace and
+// closes Config.Dst. It returns the first error encountered.
+func (im *Importer) Finish(end time.Time) error {
+	err := im.tl.end(im.ts(end))
+	if finishErr := im.tl.enc.Finish(); finishErr != nil && err == nil {
+		err = finishErr
+	}
+	if closeErr := im.c.Dst.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ts returns the trace timestamp for t in microseconds.
+func (im *Importer) ts(t time.Time) float64 {
+	return durationUs(t.Sub(im.start))
+}
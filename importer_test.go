@@ -0,0 +1,89 @@
+package fgtrace
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/DataDog/gostackparse"
+	"github.com/felixge/fgtrace/internal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Import(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	newG := func(id int, state string, funcs ...string) *Goroutine {
+		g := &Goroutine{Goroutine: gostackparse.Goroutine{ID: id, State: state}}
+		for _, fn := range funcs {
+			g.Stack = append(g.Stack, &gostackparse.Frame{Func: fn})
+		}
+		return g
+	}
+
+	buf := &bytes.Buffer{}
+	dst := &closeRecorder{WriteCloser: Writer(buf)}
+	conf := Config{Dst: dst, Exclude: Filter{States: []string{"select"}}}
+	im, err := conf.Import(start)
+	require.NoError(t, err)
+
+	worker := newG(2, "running", "main.worker")
+	worker.CreatedByID = 1
+	require.NoError(t, im.Goroutine(at(0), newG(1, "running", "main.main"), false))
+	require.NoError(t, im.Goroutine(at(1), worker, true))
+	require.NoError(t, im.Goroutine(at(2), newG(2, "select", "main.worker"), false))
+	require.NoError(t, im.Goroutine(at(3), newG(3, "running", "main.other"), false))
+	require.NoError(t, im.Exit(at(4), 3))
+	require.NoError(t, im.Exit(at(4), 42))
+	require.NoError(t, im.Annotate(Annotation{Kind: RegionAnnotation, G: 1, Name: "query", Start: at(1), End: at(3)}))
+	require.False(t, dst.closed)
+	require.NoError(t, im.Finish(at(5)))
+	require.True(t, dst.closed)
+
+	data, err := internal.Unmarshal(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, 0, data.MetaHz())
+	type span struct {
+		Ph   string
+		Pid  int64
+		Name string
+		Ts   float64
+	}
+	var spans []span
+	for _, e := range data.Events {
+		switch e.Ph {
+		case "B", "E", "s", "f", "X":
+			spans = append(spans, span{e.Ph, e.Pid, e.Name, e.Ts})
+		}
+	}
+	require.Equal(t, []span{
+		{"B", 1, "running", 0},
+		{"B", 1, "main.main", 0},
+		{"B", 2, "running", 1000},
+		{"B", 2, "main.worker", 1000},
+		{"s", 1, "go", 1000},
+		{"f", 2, "go", 1000},
+		// Excluded by the state filter.
+		{"E", 2, "main.worker", 2000},
+		{"E", 2, "running", 2000},
+		{"B", 3, "running", 3000},
+		{"B", 3, "main.other", 3000},
+		{"E", 3, "main.other", 4000},
+		{"E", 3, "running", 4000},
+		{"X", 1, "query", 1000},
+		{"E", 1, "main.main", 5000},
+		{"E", 1, "running", 5000},
+	}, spans)
+}
+
+// closeRecorder records if Close() was called.
+type closeRecorder struct {
+	io.WriteCloser
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return c.WriteCloser.Close()
+}
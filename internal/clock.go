@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for traces. It allows tests to control time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the interface of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// RealClock implements Clock using the time package.
+type RealClock struct{}
+
+// Now implements Clock.
+func (RealClock) Now() time.Time { return time.Now() }
+
+// NewTicker implements Clock.
+func (RealClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// FakeClock is a Clock whose time only moves when Advance() is called.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// Now implements Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker implements Clock.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		clock: c,
+		c:     make(chan time.Time),
+		stop:  make(chan struct{}),
+		d:     d,
+		next:  c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d. Every tick that becomes due is
+// delivered in order, and Advance blocks until it has been received, or the
+// ticker has been stopped. Unlike time.Ticker, no ticks are dropped.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		var due *fakeTicker
+		for _, t := range c.tickers {
+			if t.stopped() || t.next.After(end) {
+				continue
+			} else if due == nil || t.next.Before(due.next) {
+				due = t
+			}
+		}
+		if due == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = due.next
+		due.next = due.next.Add(due.d)
+		now := c.now
+		c.mu.Unlock()
+
+		select {
+		case due.c <- now:
+		case <-due.stop:
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	c     chan time.Time
+	stop  chan struct{}
+	once  sync.Once
+	d     time.Duration // guarded by clock.mu
+	next  time.Time     // guarded by clock.mu
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+// Reset implements Ticker. Like time.Ticker, the next tick is due d after
+// the current time.
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.d = d
+	t.next = t.clock.now.Add(d)
+}
+
+func (t *fakeTicker) Stop() { t.once.Do(func() { close(t.stop) }) }
+
+func (t *fakeTicker) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
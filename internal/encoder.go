@@ -8,18 +8,23 @@ import (
 	"fmt"
 	"io"
 	"strings"
-
-	"github.com/DataDog/gostackparse"
 )
 
+// NewEncoder returns an Encoder that writes the JSON Trace Event Format to w.
 func NewEncoder(w io.Writer) (*Encoder, error) {
-	e := &Encoder{
+	jw := &jsonWriter{
 		w:     w,
 		json:  *json.NewEncoder(w),
 		first: true,
 	}
 	_, err := w.Write([]byte("["))
-	return e, err
+	return &Encoder{w: jw}, err
+}
+
+// NewPerfettoEncoder returns an Encoder that writes Perfetto's protobuf trace
+// format to w.
+func NewPerfettoEncoder(w io.Writer) (*Encoder, error) {
+	return &Encoder{w: newPerfettoWriter(w)}, nil
 }
 
 func Unmarshal(data []byte) (*TraceData, error) {
@@ -133,15 +138,37 @@ type Event struct {
 	Pid  int64                  `json:"pid,omitempty"`
 	Tid  int64                  `json:"tid,omitempty"`
 	Args map[string]interface{} `json:"args,omitempty"`
+	// Cat, ID and Bp are used by flow and async events.
+	Cat string `json:"cat,omitempty"`
+	ID  uint64 `json:"id,omitempty"`
+	Bp  string `json:"bp,omitempty"`
+	// Dur is the duration of complete events in microseconds.
+	Dur float64 `json:"dur,omitempty"`
+	// S is the scope of instant events.
+	S string `json:"s,omitempty"`
 }
 
 // Encoder implements a small subset of the "Trace Event Format" spec needed to
 // make fgtrace output data that can be displayed by perfetto.dev.
 // https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU/preview
+//
+// The events are serialized by an eventWriter, which allows the same events to
+// be written as JSON or Perfetto's protobuf format.
 type Encoder struct {
-	w     io.Writer
-	json  json.Encoder
-	first bool
+	// CallSites causes frames to be compared by their function as well as the
+	// file and line they were called from, so calls of the same function from
+	// different call sites of its caller become separate slices.
+	CallSites bool
+
+	w                eventWriter
+	runtimeTracks    map[RuntimeTrack]bool // runtime tracks that have been named
+	annotationTracks map[int]bool          // goroutines whose annotation track has been named
+}
+
+// eventWriter serializes events into a specific file format.
+type eventWriter interface {
+	WriteEvent(ev *Event) error
+	Finish() error
 }
 
 func (e *Encoder) CustomMeta(name string, value interface{}) error {
@@ -153,7 +180,19 @@ func (e *Encoder) CustomMeta(name string, value interface{}) error {
 	return e.encode(&ev)
 }
 
-func (e *Encoder) Encode(ts float64, prev, current *gostackparse.Goroutine) error {
+// Instant encodes a global instant event with the given name and args at ts.
+func (e *Encoder) Instant(ts float64, name string, args map[string]interface{}) error {
+	ev := Event{Name: name, Ph: "i", S: "g", Ts: ts, Args: args}
+	return e.encode(&ev)
+}
+
+// Event encodes ev as is. It allows writing events that were read from an
+// existing trace, e.g. to convert it to a different format.
+func (e *Encoder) Event(ev *Event) error {
+	return e.encode(ev)
+}
+
+func (e *Encoder) Encode(ts float64, prev, current *Goroutine) error {
 	ev := Event{Ts: ts, Tid: 1}
 	prevLen := 0
 	if prev != nil {
@@ -176,6 +215,9 @@ func (e *Encoder) Encode(ts float64, prev, current *gostackparse.Goroutine) erro
 			name += " " + current.CreatedBy.Func
 		}
 		metaEv.Args = map[string]interface{}{"name": name}
+		if current.Labels != nil {
+			metaEv.Args["labels"] = current.Labels
+		}
 		if err := e.encode(&metaEv); err != nil {
 			return err
 		}
@@ -187,7 +229,7 @@ func (e *Encoder) Encode(ts float64, prev, current *gostackparse.Goroutine) erro
 	for i := 0; i < prevLen; i++ {
 		ci := currentLen - i - 1
 		pi := prevLen - i - 1
-		if ci < 0 || prev.Stack[pi].Func != current.Stack[ci].Func {
+		if ci < 0 || !e.sameFrame(prev, pi, current, ci) {
 			commonDepth = i
 			break
 		}
@@ -205,10 +247,24 @@ func (e *Encoder) Encode(ts float64, prev, current *gostackparse.Goroutine) erro
 
 	// Emit start events for current stack frames that were not part of the prev
 	// stack going from root to leaf frame.
+	args := goroutineArgs(current)
 	for i := commonDepth; i < currentLen; i++ {
 		ci := currentLen - i - 1
+		f := current.Stack[ci]
+		// The args are written before the next iteration, so they can be
+		// reused.
+		if f.File != "" {
+			if args == nil {
+				args = map[string]interface{}{}
+			}
+			args["file"], args["line"] = f.File, f.Line
+		} else if args != nil {
+			delete(args, "file")
+			delete(args, "line")
+		}
 		ev.Ph = "B"
-		ev.Name = current.Stack[ci].Func
+		ev.Name = f.Func
+		ev.Args = args
 		if err := e.encode(&ev); err != nil {
 			return err
 		}
@@ -216,18 +272,210 @@ func (e *Encoder) Encode(ts float64, prev, current *gostackparse.Goroutine) erro
 	return nil
 }
 
+// sameFrame returns true if the frames prev.Stack[pi] and current.Stack[ci]
+// belong to the same slice.
+func (e *Encoder) sameFrame(prev *Goroutine, pi int, current *Goroutine, ci int) bool {
+	if prev.Stack[pi].Func != current.Stack[ci].Func {
+		return false
+	} else if !e.CallSites || pi+1 >= len(prev.Stack) || ci+1 >= len(current.Stack) {
+		return true
+	}
+	// The call site of a frame is the current position of its caller.
+	prevCaller, currentCaller := prev.Stack[pi+1], current.Stack[ci+1]
+	return prevCaller.File == currentCaller.File && prevCaller.Line == currentCaller.Line
+}
+
+// Flow encodes a flow event from the active slice of the goroutine with the
+// id from to the first slice of the goroutine with the id to, which has been
+// created by it. Goroutine ids are unique, so to is used as the flow id.
+func (e *Encoder) Flow(ts float64, from, to int) error {
+	ev := Event{Name: "go", Cat: "goroutine", Ph: "s", Ts: ts, Pid: int64(from), Tid: 1, ID: uint64(to)}
+	if err := e.encode(&ev); err != nil {
+		return err
+	}
+	// Bind the flow end to the enclosing slice rather than the next one.
+	ev.Ph, ev.Pid, ev.Bp = "f", int64(to), "e"
+	return e.encode(&ev)
+}
+
+// RuntimePid is the pid of the "runtime" process that holds the events
+// describing the runtime and fgtrace itself rather than a goroutine, see
+// Encoder.RuntimeSlice().
+const RuntimePid = 0
+
+// RuntimeTrack is the tid of a track of the "runtime" process.
+type RuntimeTrack int64
+
+const (
+	// GCTrack holds the stop-the-world pauses of the garbage collector.
+	GCTrack RuntimeTrack = 1
+	// OverheadTrack holds the time spent by fgtrace for capturing and
+	// encoding the samples.
+	OverheadTrack RuntimeTrack = 2
+	// GCCycleTrack holds the GC cycles of the garbage collector from the
+	// start of the concurrent mark phase to the end of the cycle. They are
+	// kept apart from GCTrack because the pauses of a cycle may not nest
+	// within it.
+	GCCycleTrack RuntimeTrack = 3
+)
+
+var runtimeTrackNames = map[RuntimeTrack]string{
+	GCTrack:       "GC",
+	OverheadTrack: "fgtrace overhead",
+	GCCycleTrack:  "GC cycles",
+}
+
+// RuntimeSlice encodes a complete event with the given name, start ts and
+// duration on the given track of the "runtime" process. The process and track
+// are named when they are used for the first time.
+func (e *Encoder) RuntimeSlice(track RuntimeTrack, ts, dur float64, name string, args map[string]interface{}) error {
+	if e.runtimeTracks == nil {
+		e.runtimeTracks = map[RuntimeTrack]bool{}
+		metaEv := Event{
+			Name: "process_name",
+			Ph:   "M",
+			Pid:  RuntimePid,
+			Tid:  1,
+			Args: map[string]interface{}{"name": "runtime"},
+		}
+		if err := e.encode(&metaEv); err != nil {
+			return err
+		}
+	}
+	if !e.runtimeTracks[track] {
+		e.runtimeTracks[track] = true
+		metaEv := Event{
+			Name: "thread_name",
+			Ph:   "M",
+			Pid:  RuntimePid,
+			Tid:  int64(track),
+			Args: map[string]interface{}{"name": runtimeTrackNames[track]},
+		}
+		if err := e.encode(&metaEv); err != nil {
+			return err
+		}
+	}
+	ev := Event{Name: name, Ph: "X", Ts: ts, Dur: dur, Pid: RuntimePid, Tid: int64(track), Args: args}
+	return e.encode(&ev)
+}
+
+// AnnotationTid is the tid of the track that holds the user annotations of a
+// goroutine next to the track of its sampled stacks, see Encoder.Region().
+const AnnotationTid = 2
+
+// Region encodes a complete event with the given name, start ts and duration
+// on the annotation track of the goroutine with the given id. Unlike the
+// sampled stacks, regions are not limited to the sampling rate.
+func (e *Encoder) Region(g int, ts, dur float64, name string, args map[string]interface{}) error {
+	if err := e.annotationTrack(g); err != nil {
+		return err
+	}
+	ev := Event{Name: name, Ph: "X", Ts: ts, Dur: dur, Pid: int64(g), Tid: AnnotationTid, Args: args}
+	return e.encode(&ev)
+}
+
+// Log encodes an instant event with the given name at ts on the annotation
+// track of the goroutine with the given id.
+func (e *Encoder) Log(g int, ts float64, name string, args map[string]interface{}) error {
+	if err := e.annotationTrack(g); err != nil {
+		return err
+	}
+	ev := Event{Name: name, Ph: "i", S: "t", Ts: ts, Pid: int64(g), Tid: AnnotationTid, Args: args}
+	return e.encode(&ev)
+}
+
+// Task encodes an async slice with the given id, name, start ts and duration
+// in the process of the goroutine with the given id. Tasks may span several
+// goroutines, so each of them gets its own track.
+func (e *Encoder) Task(g int, id uint64, ts, dur float64, name string, args map[string]interface{}) error {
+	ev := Event{Name: name, Cat: "task", Ph: "b", Ts: ts, Pid: int64(g), Tid: AnnotationTid, ID: id, Args: args}
+	if err := e.encode(&ev); err != nil {
+		return err
+	}
+	ev.Ph, ev.Ts, ev.Args = "e", ts+dur, nil
+	return e.encode(&ev)
+}
+
+// annotationTrack names the annotation track of the goroutine with the given
+// id when it is used for the first time.
+func (e *Encoder) annotationTrack(g int) error {
+	if e.annotationTracks[g] {
+		return nil
+	} else if e.annotationTracks == nil {
+		e.annotationTracks = map[int]bool{}
+	}
+	e.annotationTracks[g] = true
+	metaEv := Event{
+		Name: "thread_name",
+		Ph:   "M",
+		Pid:  int64(g),
+		Tid:  AnnotationTid,
+		Args: map[string]interface{}{"name": "annotations"},
+	}
+	return e.encode(&metaEv)
+}
+
+// Counter encodes the value of the counter track with the given name at ts.
+func (e *Encoder) Counter(ts float64, name string, value float64) error {
+	ev := Event{
+		Name: name,
+		Ph:   "C",
+		Ts:   ts,
+		Args: map[string]interface{}{"value": value},
+	}
+	return e.encode(&ev)
+}
+
+// goroutineArgs returns the args for the begin events of g, or nil if there
+// is nothing to report.
+func goroutineArgs(g *Goroutine) map[string]interface{} {
+	if g == nil || (g.Labels == nil && g.Wait == 0 && !g.LockedToThread && !g.ApproximateID) {
+		return nil
+	}
+	args := map[string]interface{}{}
+	if g.Labels != nil {
+		args["labels"] = g.Labels
+	}
+	if g.Wait != 0 {
+		// The runtime reports the wait duration in minutes only.
+		args["wait_minutes"] = int(g.Wait.Minutes())
+	}
+	if g.LockedToThread {
+		args["locked_to_thread"] = true
+	}
+	if g.ApproximateID {
+		args["approximate_id"] = true
+	}
+	return args
+}
+
 func (e *Encoder) encode(ev *Event) error {
-	if !e.first {
-		if _, err := e.w.Write([]byte(",")); err != nil {
+	return e.w.WriteEvent(ev)
+}
+
+func (e *Encoder) Finish() error {
+	return e.w.Finish()
+}
+
+// jsonWriter writes events as a JSON array.
+type jsonWriter struct {
+	w     io.Writer
+	json  json.Encoder
+	first bool
+}
+
+func (j *jsonWriter) WriteEvent(ev *Event) error {
+	if !j.first {
+		if _, err := j.w.Write([]byte(",")); err != nil {
 			return err
 		}
 	} else {
-		e.first = false
+		j.first = false
 	}
-	return e.json.Encode(ev)
+	return j.json.Encode(ev)
 }
 
-func (e *Encoder) Finish() error {
-	_, err := e.w.Write([]byte("]"))
+func (j *jsonWriter) Finish() error {
+	_, err := j.w.Write([]byte("]"))
 	return err
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/DataDog/gostackparse"
 	"github.com/stretchr/testify/require"
@@ -13,8 +14,8 @@ func Test_writeEvents(t *testing.T) {
 	tests := []struct {
 		Name    string
 		Ts      int64
-		Prev    *gostackparse.Goroutine
-		Current *gostackparse.Goroutine
+		Prev    *Goroutine
+		Current *Goroutine
 		Want    []Event
 	}{
 		{
@@ -62,6 +63,34 @@ func Test_writeEvents(t *testing.T) {
 			},
 		},
 
+		{
+			Name: "args",
+			Ts:   5000,
+			Current: func() *Goroutine {
+				g := newTestGoroutine(42, "foo", "main")
+				g.Labels = map[string]string{"endpoint": "/users"}
+				g.Wait = 3 * time.Minute
+				g.LockedToThread = true
+				return g
+			}(),
+			Want: []Event{
+				{Name: "process_name", Ph: "M", Ts: 0, Pid: 42, Tid: 1, Args: map[string]interface{}{
+					"name":   "G42",
+					"labels": map[string]interface{}{"endpoint": "/users"},
+				}},
+				{Name: "main", Ph: "B", Ts: 5000, Pid: 42, Tid: 1, Args: map[string]interface{}{
+					"labels":           map[string]interface{}{"endpoint": "/users"},
+					"wait_minutes":     float64(3),
+					"locked_to_thread": true,
+				}},
+				{Name: "foo", Ph: "B", Ts: 5000, Pid: 42, Tid: 1, Args: map[string]interface{}{
+					"labels":           map[string]interface{}{"endpoint": "/users"},
+					"wait_minutes":     float64(3),
+					"locked_to_thread": true,
+				}},
+			},
+		},
+
 		{
 			Name: "finish",
 			Ts:   5000,
@@ -87,15 +116,93 @@ func Test_writeEvents(t *testing.T) {
 	}
 }
 
-func newTestGoroutine(gid int, stack ...string) *gostackparse.Goroutine {
+func newTestGoroutine(gid int, stack ...string) *Goroutine {
 	frames := make([]gostackparse.Frame, len(stack))
-	g := &gostackparse.Goroutine{
+	g := &Goroutine{Goroutine: gostackparse.Goroutine{
 		ID:    gid,
 		Stack: make([]*gostackparse.Frame, len(stack)),
-	}
+	}}
 	for i, fn := range stack {
 		frames[i].Func = fn
 		g.Stack[i] = &frames[i]
 	}
 	return g
 }
+
+func TestEncoder_CallSites(t *testing.T) {
+	goroutine := func(lines ...int) *Goroutine {
+		g := newTestGoroutine(42, "baz", "bar", "main")
+		for i, f := range g.Stack {
+			f.File = f.Func + ".go"
+			f.Line = lines[i]
+		}
+		return g
+	}
+	// main calls bar from line 20 instead of line 10, bar stays on line 5.
+	prev, current := goroutine(1, 5, 10), goroutine(2, 5, 20)
+
+	for _, callSites := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		e, err := NewEncoder(buf)
+		require.NoError(t, err)
+		e.CallSites = callSites
+		require.NoError(t, e.Encode(1000, prev, current))
+		require.NoError(t, e.Finish())
+		var got []Event
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+
+		if !callSites {
+			require.Empty(t, got)
+			continue
+		}
+		require.Equal(t, []Event{
+			{Name: "baz", Ph: "E", Ts: 1000, Pid: 42, Tid: 1},
+			{Name: "bar", Ph: "E", Ts: 1000, Pid: 42, Tid: 1},
+			{Name: "bar", Ph: "B", Ts: 1000, Pid: 42, Tid: 1, Args: map[string]interface{}{"file": "bar.go", "line": float64(5)}},
+			{Name: "baz", Ph: "B", Ts: 1000, Pid: 42, Tid: 1, Args: map[string]interface{}{"file": "baz.go", "line": float64(2)}},
+		}, got)
+	}
+}
+
+func TestEncoder_RuntimeSlice(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewEncoder(buf)
+	require.NoError(t, err)
+	require.NoError(t, e.RuntimeSlice(GCTrack, 1000, 50, "GC pause", map[string]interface{}{"gc": 1}))
+	require.NoError(t, e.RuntimeSlice(OverheadTrack, 1500, 10, "Goroutines", nil))
+	require.NoError(t, e.RuntimeSlice(GCTrack, 2000, 60, "GC pause", map[string]interface{}{"gc": 2}))
+	require.NoError(t, e.Finish())
+	var got []Event
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Equal(t, []Event{
+		{Name: "process_name", Ph: "M", Pid: RuntimePid, Tid: 1, Args: map[string]interface{}{"name": "runtime"}},
+		{Name: "thread_name", Ph: "M", Pid: RuntimePid, Tid: 1, Args: map[string]interface{}{"name": "GC"}},
+		{Name: "GC pause", Ph: "X", Ts: 1000, Dur: 50, Pid: RuntimePid, Tid: 1, Args: map[string]interface{}{"gc": float64(1)}},
+		{Name: "thread_name", Ph: "M", Pid: RuntimePid, Tid: 2, Args: map[string]interface{}{"name": "fgtrace overhead"}},
+		{Name: "Goroutines", Ph: "X", Ts: 1500, Dur: 10, Pid: RuntimePid, Tid: 2},
+		{Name: "GC pause", Ph: "X", Ts: 2000, Dur: 60, Pid: RuntimePid, Tid: 1, Args: map[string]interface{}{"gc": float64(2)}},
+	}, got)
+}
+
+func TestEncoder_Annotations(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewEncoder(buf)
+	require.NoError(t, err)
+	task := map[string]interface{}{"task": "request", "task_id": 3}
+	require.NoError(t, e.Region(7, 1000, 50, "query", task))
+	require.NoError(t, e.Log(7, 1060, "user", map[string]interface{}{"value": "42"}))
+	require.NoError(t, e.Task(7, 3, 900, 200, "request", nil))
+	require.NoError(t, e.Region(8, 1100, 10, "render", nil))
+	require.NoError(t, e.Finish())
+	var got []Event
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Equal(t, []Event{
+		{Name: "thread_name", Ph: "M", Pid: 7, Tid: AnnotationTid, Args: map[string]interface{}{"name": "annotations"}},
+		{Name: "query", Ph: "X", Ts: 1000, Dur: 50, Pid: 7, Tid: AnnotationTid, Args: map[string]interface{}{"task": "request", "task_id": float64(3)}},
+		{Name: "user", Ph: "i", S: "t", Ts: 1060, Pid: 7, Tid: AnnotationTid, Args: map[string]interface{}{"value": "42"}},
+		{Name: "request", Cat: "task", Ph: "b", Ts: 900, Pid: 7, Tid: AnnotationTid, ID: 3},
+		{Name: "request", Cat: "task", Ph: "e", Ts: 1100, Pid: 7, Tid: AnnotationTid, ID: 3},
+		{Name: "thread_name", Ph: "M", Pid: 8, Tid: AnnotationTid, Args: map[string]interface{}{"name": "annotations"}},
+		{Name: "render", Ph: "X", Ts: 1100, Dur: 10, Pid: 8, Tid: AnnotationTid},
+	}, got)
+}
@@ -0,0 +1,18 @@
+package internal
+
+import "github.com/DataDog/gostackparse"
+
+// Goroutine is a snapshot of a single goroutine taken by a profiler.
+type Goroutine struct {
+	gostackparse.Goroutine
+	// Labels are the pprof labels of the goroutine, see runtime/pprof.Do(). Nil
+	// if the goroutine has no labels or the profiler doesn't capture them.
+	Labels map[string]string
+	// CreatedByID is the id of the goroutine that created this goroutine, or 0
+	// if it is unknown.
+	CreatedByID int
+	// ApproximateID is true if the profiler doesn't know the id of the
+	// goroutine and guessed it, so it may have been a different goroutine in
+	// the previous snapshot.
+	ApproximateID bool
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// NewGzipWriter returns an io.WriteCloser that gzip compresses the data
+// written to it into w. Close() flushes the compressed data and closes w.
+func NewGzipWriter(w io.WriteCloser) io.WriteCloser {
+	return &gzipWriter{gz: gzip.NewWriter(w), w: w}
+}
+
+type gzipWriter struct {
+	gz *gzip.Writer
+	w  io.WriteCloser
+}
+
+// Write implements io.Writer.
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	return g.gz.Write(p)
+}
+
+// Close implements io.Closer.
+func (g *gzipWriter) Close() error {
+	err := g.gz.Close()
+	if closeErr := g.w.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// String implements fmt.Stringer.
+func (g *gzipWriter) String() string {
+	return fmt.Sprint(g.w)
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dst := &closeRecorder{Writer: buf}
+	gw := NewGzipWriter(dst)
+	for _, w := range []string{"Hello ", "World\n"} {
+		n, err := gw.Write([]byte(w))
+		require.NoError(t, err)
+		require.Equal(t, len(w), n)
+	}
+	require.False(t, dst.closed)
+	require.NoError(t, gw.Close())
+	require.True(t, dst.closed)
+
+	gr, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	require.Equal(t, "Hello World\n", string(data))
+}
+
+type closeRecorder struct {
+	io.Writer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
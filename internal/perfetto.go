@@ -0,0 +1,391 @@
+package internal
+
+// Implementation of Perfetto's protobuf based trace format, see:
+// https://perfetto.dev/docs/reference/synthetic-track-event
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Field numbers and enum values of the perfetto.protos messages used below, see:
+// https://github.com/google/perfetto/tree/master/protos/perfetto/trace
+const (
+	traceFieldPacket = 1
+
+	packetFieldTimestamp       = 8
+	packetFieldSequenceID      = 10
+	packetFieldTrackEvent      = 11
+	packetFieldInternedData    = 12
+	packetFieldSequenceFlags   = 13
+	packetFieldTrackDescriptor = 60
+
+	seqIncrementalStateCleared = 1
+	seqNeedsIncrementalState   = 2
+
+	internedDataFieldEventNames = 2
+
+	eventNameFieldIID  = 1
+	eventNameFieldName = 2
+
+	trackEventFieldDebugAnnotations = 4
+	trackEventFieldType             = 9
+	trackEventFieldNameIID          = 10
+	trackEventFieldTrackUUID        = 11
+	trackEventFieldCounterValue     = 30
+	trackEventFieldDoubleCounter    = 44
+	trackEventFieldFlowIDs          = 47
+	trackEventFieldTerminatingFlows = 48
+
+	trackEventTypeSliceBegin = 1
+	trackEventTypeSliceEnd   = 2
+	trackEventTypeInstant    = 3
+	trackEventTypeCounter    = 4
+
+	debugAnnotationFieldBool   = 2
+	debugAnnotationFieldInt    = 4
+	debugAnnotationFieldDouble = 5
+	debugAnnotationFieldString = 6
+	debugAnnotationFieldName   = 10
+	debugAnnotationFieldDict   = 11
+
+	trackDescriptorFieldUUID       = 1
+	trackDescriptorFieldName       = 2
+	trackDescriptorFieldProcess    = 3
+	trackDescriptorFieldParentUUID = 5
+	trackDescriptorFieldCounter    = 8
+
+	processDescriptorFieldPid         = 1
+	processDescriptorFieldProcessName = 6
+)
+
+const (
+	// perfettoSequenceID is the trusted_packet_sequence_id of all packets. All
+	// packets belong to the same sequence which scopes the interned data.
+	perfettoSequenceID = 1
+	// perfettoMetaTrack is the uuid of the track that holds the events
+	// written via Encoder.CustomMeta().
+	perfettoMetaTrack = 1
+	// perfettoFirstCounterTrack is the uuid of the first counter track. The
+	// uuids of counter tracks are below the ones of perfettoTrackUUID().
+	perfettoFirstCounterTrack = 2
+)
+
+func newPerfettoWriter(w io.Writer) *perfettoWriter {
+	return &perfettoWriter{
+		w:        w,
+		first:    true,
+		names:    map[string]uint64{},
+		tracks:   map[uint64]bool{},
+		counters: map[string]uint64{},
+	}
+}
+
+// perfettoWriter writes events as a stream of TracePacket messages. Each
+// goroutine (Pid) is represented by a process track and each Tid by a child
+// track of it. Counters get a counter track per name. Event names are interned
+// to keep the output small.
+type perfettoWriter struct {
+	w        io.Writer
+	first    bool
+	names    map[string]uint64
+	tracks   map[uint64]bool
+	counters map[string]uint64 // counter name -> track uuid
+
+	packet, msg, sub, trace protoBuf
+}
+
+func (p *perfettoWriter) WriteEvent(ev *Event) error {
+	switch ev.Ph {
+	case "M":
+		switch ev.Name {
+		case "process_name":
+			name, _ := ev.Args["name"].(string)
+			return p.processTrack(ev.Pid, name)
+		case "thread_name":
+			name, _ := ev.Args["name"].(string)
+			_, err := p.threadTrack(ev.Pid, ev.Tid, name)
+			return err
+		}
+		return p.trackEvent(ev, trackEventTypeInstant, perfettoMetaTrack)
+	case "B":
+		return p.trackEvent(ev, trackEventTypeSliceBegin, 0)
+	case "E":
+		return p.trackEvent(ev, trackEventTypeSliceEnd, 0)
+	case "i":
+		if ev.S == "t" {
+			return p.trackEvent(ev, trackEventTypeInstant, 0)
+		}
+		return p.trackEvent(ev, trackEventTypeInstant, perfettoMetaTrack)
+	case "C":
+		return p.counter(ev)
+	case "X":
+		// Complete events are split into a begin and end event.
+		if err := p.trackEvent(ev, trackEventTypeSliceBegin, 0); err != nil {
+			return err
+		}
+		end := *ev
+		end.Ts += ev.Dur
+		return p.trackEvent(&end, trackEventTypeSliceEnd, 0)
+	case "s", "f":
+		// Flows are attached to an instant event on the track of the goroutine.
+		return p.trackEvent(ev, trackEventTypeInstant, 0)
+	case "b", "e":
+		uuid, err := p.asyncTrack(ev)
+		if err != nil {
+			return err
+		} else if ev.Ph == "b" {
+			return p.trackEvent(ev, trackEventTypeSliceBegin, uuid)
+		}
+		return p.trackEvent(ev, trackEventTypeSliceEnd, uuid)
+	default:
+		return fmt.Errorf("perfetto: unsupported event phase: %q", ev.Ph)
+	}
+}
+
+// Finish implements eventWriter. Perfetto traces are a plain sequence of
+// packets, so there is nothing left to write.
+func (p *perfettoWriter) Finish() error {
+	return nil
+}
+
+// processTrack emits the descriptor of the process track for pid.
+func (p *perfettoWriter) processTrack(pid int64, name string) error {
+	uuid := perfettoTrackUUID(pid, 0)
+	p.tracks[uuid] = true
+
+	p.sub = p.sub[:0]
+	p.sub.Int64(processDescriptorFieldPid, pid)
+	if name != "" {
+		p.sub.String(processDescriptorFieldProcessName, name)
+	}
+	p.msg = p.msg[:0]
+	p.msg.Uint64(trackDescriptorFieldUUID, uuid)
+	p.msg.Message(trackDescriptorFieldProcess, p.sub)
+	return p.writeTrackDescriptor()
+}
+
+// track returns the uuid of the track for the pid and tid of ev and emits its
+// descriptor if needed.
+func (p *perfettoWriter) track(ev *Event) (uint64, error) {
+	uuid := perfettoTrackUUID(ev.Pid, ev.Tid)
+	if p.tracks[uuid] {
+		return uuid, nil
+	}
+	return p.threadTrack(ev.Pid, ev.Tid, "")
+}
+
+// threadTrack emits the descriptor of the track for pid and tid as a child of
+// the process track for pid and returns its uuid.
+func (p *perfettoWriter) threadTrack(pid, tid int64, name string) (uint64, error) {
+	uuid := perfettoTrackUUID(pid, tid)
+	parent := perfettoTrackUUID(pid, 0)
+	if !p.tracks[parent] {
+		if err := p.processTrack(pid, ""); err != nil {
+			return 0, err
+		}
+	}
+	p.tracks[uuid] = true
+
+	p.msg = p.msg[:0]
+	p.msg.Uint64(trackDescriptorFieldUUID, uuid)
+	p.msg.Uint64(trackDescriptorFieldParentUUID, parent)
+	if name != "" {
+		p.msg.String(trackDescriptorFieldName, name)
+	}
+	return uuid, p.writeTrackDescriptor()
+}
+
+// asyncTrack returns the uuid of the track for the async event ev and emits
+// its descriptor as a child of the process track of its pid if needed.
+func (p *perfettoWriter) asyncTrack(ev *Event) (uint64, error) {
+	uuid := perfettoAsyncTrackUUID(ev.ID)
+	if p.tracks[uuid] {
+		return uuid, nil
+	}
+	parent := perfettoTrackUUID(ev.Pid, 0)
+	if !p.tracks[parent] {
+		if err := p.processTrack(ev.Pid, ""); err != nil {
+			return 0, err
+		}
+	}
+	p.tracks[uuid] = true
+
+	p.msg = p.msg[:0]
+	p.msg.Uint64(trackDescriptorFieldUUID, uuid)
+	p.msg.Uint64(trackDescriptorFieldParentUUID, parent)
+	p.msg.String(trackDescriptorFieldName, ev.Name)
+	return uuid, p.writeTrackDescriptor()
+}
+
+// counter writes the value of the counter ev to the counter track for its name
+// and emits the descriptor of the track if needed.
+func (p *perfettoWriter) counter(ev *Event) error {
+	uuid, ok := p.counters[ev.Name]
+	if !ok {
+		uuid = uint64(perfettoFirstCounterTrack + len(p.counters))
+		if uuid >= perfettoTrackUUID(0, 0) {
+			return fmt.Errorf("perfetto: too many counters: %q", ev.Name)
+		}
+		p.counters[ev.Name] = uuid
+		p.sub = p.sub[:0]
+		p.msg = p.msg[:0]
+		p.msg.Uint64(trackDescriptorFieldUUID, uuid)
+		p.msg.String(trackDescriptorFieldName, ev.Name)
+		p.msg.Message(trackDescriptorFieldCounter, p.sub)
+		if err := p.writeTrackDescriptor(); err != nil {
+			return err
+		}
+	}
+
+	p.packet = p.packet[:0]
+	p.packet.Uint64(packetFieldTimestamp, uint64(ev.Ts*1000))
+	p.msg = p.msg[:0]
+	p.msg.Uint64(trackEventFieldType, trackEventTypeCounter)
+	p.msg.Uint64(trackEventFieldTrackUUID, uuid)
+	// The value is a float64 when written by fgtrace or read from JSON, but
+	// integers are accepted as well.
+	switch v := ev.Args["value"].(type) {
+	case float64:
+		p.msg.Double(trackEventFieldDoubleCounter, v)
+	case int:
+		p.msg.Int64(trackEventFieldCounterValue, int64(v))
+	case int64:
+		p.msg.Int64(trackEventFieldCounterValue, v)
+	default:
+		return fmt.Errorf("perfetto: unsupported counter value: %v", v)
+	}
+	p.packet.Message(packetFieldTrackEvent, p.msg)
+	return p.writePacket()
+}
+
+func (p *perfettoWriter) writeTrackDescriptor() error {
+	p.packet = p.packet[:0]
+	p.packet.Message(packetFieldTrackDescriptor, p.msg)
+	return p.writePacket()
+}
+
+// trackEvent writes ev as a TrackEvent of the given type. The track is derived
+// from ev unless trackUUID is non-zero.
+func (p *perfettoWriter) trackEvent(ev *Event, typ uint64, trackUUID uint64) error {
+	if trackUUID == perfettoMetaTrack && !p.tracks[trackUUID] {
+		p.tracks[trackUUID] = true
+		p.msg = p.msg[:0]
+		p.msg.Uint64(trackDescriptorFieldUUID, trackUUID)
+		p.msg.String(trackDescriptorFieldName, "fgtrace")
+		if err := p.writeTrackDescriptor(); err != nil {
+			return err
+		}
+	} else if trackUUID == 0 {
+		var err error
+		if trackUUID, err = p.track(ev); err != nil {
+			return err
+		}
+	}
+
+	p.packet = p.packet[:0]
+	// ev.Ts is in microseconds, perfetto expects nanoseconds.
+	p.packet.Uint64(packetFieldTimestamp, uint64(ev.Ts*1000))
+
+	p.msg = p.msg[:0]
+	p.msg.Uint64(trackEventFieldType, typ)
+	p.msg.Uint64(trackEventFieldTrackUUID, trackUUID)
+	if typ != trackEventTypeSliceEnd {
+		iid, ok := p.names[ev.Name]
+		if !ok {
+			iid = uint64(len(p.names) + 1)
+			p.names[ev.Name] = iid
+			p.sub = p.sub[:0]
+			p.sub.Uint64(eventNameFieldIID, iid)
+			p.sub.String(eventNameFieldName, ev.Name)
+			var interned protoBuf
+			interned.Message(internedDataFieldEventNames, p.sub)
+			p.packet.Message(packetFieldInternedData, interned)
+		}
+		p.msg.Uint64(trackEventFieldNameIID, iid)
+		for _, name := range sortedKeys(ev.Args) {
+			p.sub = p.sub[:0]
+			p.sub.String(debugAnnotationFieldName, name)
+			appendDebugAnnotationValue(&p.sub, ev.Args[name])
+			p.msg.Message(trackEventFieldDebugAnnotations, p.sub)
+		}
+	}
+	switch ev.Ph {
+	case "s":
+		p.msg.Fixed64(trackEventFieldFlowIDs, ev.ID)
+	case "f":
+		p.msg.Fixed64(trackEventFieldTerminatingFlows, ev.ID)
+	}
+	p.packet.Message(packetFieldTrackEvent, p.msg)
+	return p.writePacket()
+}
+
+// writePacket completes the packet in p.packet and writes it to p.w.
+func (p *perfettoWriter) writePacket() error {
+	p.packet.Uint64(packetFieldSequenceID, perfettoSequenceID)
+	flags := uint64(seqNeedsIncrementalState)
+	if p.first {
+		p.first = false
+		flags |= seqIncrementalStateCleared
+	}
+	p.packet.Uint64(packetFieldSequenceFlags, flags)
+
+	p.trace = p.trace[:0]
+	p.trace.Message(traceFieldPacket, p.packet)
+	_, err := p.w.Write(p.trace)
+	return err
+}
+
+// perfettoTrackUUID returns the uuid of the track for the given pid and tid,
+// tid 0 is the process track. The +1 keeps the uuids of pid 0 from colliding
+// with perfettoMetaTrack.
+func perfettoTrackUUID(pid, tid int64) uint64 {
+	return uint64(pid+1)<<16 | uint64(tid)&0xffff
+}
+
+// perfettoAsyncTrackUUID returns the uuid of the track for the async events
+// with the given id. The high bit keeps them from colliding with the uuids of
+// perfettoTrackUUID().
+func perfettoAsyncTrackUUID(id uint64) uint64 {
+	return 1<<63 | id
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendDebugAnnotationValue(b *protoBuf, val interface{}) {
+	switch v := val.(type) {
+	case string:
+		b.String(debugAnnotationFieldString, v)
+	case bool:
+		b.Bool(debugAnnotationFieldBool, v)
+	case int:
+		b.Int64(debugAnnotationFieldInt, int64(v))
+	case int64:
+		b.Int64(debugAnnotationFieldInt, v)
+	case float64:
+		b.Double(debugAnnotationFieldDouble, v)
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = val
+		}
+		appendDebugAnnotationValue(b, m)
+	case map[string]interface{}:
+		for _, name := range sortedKeys(v) {
+			var entry protoBuf
+			entry.String(debugAnnotationFieldName, name)
+			appendDebugAnnotationValue(&entry, v[name])
+			b.Message(debugAnnotationFieldDict, entry)
+		}
+	default:
+		b.String(debugAnnotationFieldString, fmt.Sprint(v))
+	}
+}
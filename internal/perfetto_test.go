@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPerfettoEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewPerfettoEncoder(buf)
+	require.NoError(t, err)
+	require.NoError(t, e.CustomMeta("hz", 99))
+	require.NoError(t, e.Encode(1000, nil, newTestGoroutine(42, "foo", "main")))
+	require.NoError(t, e.Encode(2000, newTestGoroutine(42, "foo", "main"), newTestGoroutine(42, "bar", "main")))
+	require.NoError(t, e.Encode(3000, newTestGoroutine(42, "bar", "main"), nil))
+	require.NoError(t, e.Finish())
+
+	var (
+		names    = map[uint64]string{}
+		tracks   = map[uint64]testTrack{}
+		got      []string
+		trackOf  = map[string]uint64{}
+		seqFlags []uint64
+	)
+	for _, f := range decodeTestProto(t, buf.Bytes()) {
+		require.Equal(t, traceFieldPacket, f.Num)
+		packet := decodeTestProto(t, f.Bytes)
+		require.Equal(t, uint64(perfettoSequenceID), packet.Uint(packetFieldSequenceID))
+		seqFlags = append(seqFlags, packet.Uint(packetFieldSequenceFlags))
+		for _, interned := range packet.All(packetFieldInternedData) {
+			for _, name := range decodeTestProto(t, interned.Bytes).All(internedDataFieldEventNames) {
+				n := decodeTestProto(t, name.Bytes)
+				names[n.Uint(eventNameFieldIID)] = n.String(eventNameFieldName)
+			}
+		}
+		if desc := packet.Message(t, packetFieldTrackDescriptor); desc != nil {
+			track := testTrack{Parent: desc.Uint(trackDescriptorFieldParentUUID), Name: desc.String(trackDescriptorFieldName)}
+			if proc := desc.Message(t, trackDescriptorFieldProcess); proc != nil {
+				track.Pid = proc.Uint(processDescriptorFieldPid)
+				track.Name = proc.String(processDescriptorFieldProcessName)
+			}
+			tracks[desc.Uint(trackDescriptorFieldUUID)] = track
+		}
+		if ev := packet.Message(t, packetFieldTrackEvent); ev != nil {
+			typ := map[uint64]string{
+				trackEventTypeSliceBegin: "B",
+				trackEventTypeSliceEnd:   "E",
+				trackEventTypeInstant:    "I",
+			}[ev.Uint(trackEventFieldType)]
+			desc := typ + " " + names[ev.Uint(trackEventFieldNameIID)]
+			got = append(got, desc+" @"+strconv.FormatUint(packet.Uint(packetFieldTimestamp), 10))
+			trackOf[desc] = ev.Uint(trackEventFieldTrackUUID)
+		}
+	}
+
+	require.Equal(t, []string{
+		"I hz @0",
+		"B main @1000000",
+		"B foo @1000000",
+		"E  @2000000",
+		"B bar @2000000",
+		"E  @3000000",
+		"E  @3000000",
+	}, got)
+
+	require.Equal(t, uint64(seqIncrementalStateCleared|seqNeedsIncrementalState), seqFlags[0])
+	for _, flags := range seqFlags[1:] {
+		require.Equal(t, uint64(seqNeedsIncrementalState), flags)
+	}
+
+	require.Equal(t, testTrack{Name: "fgtrace"}, tracks[trackOf["I hz"]])
+	slices := tracks[trackOf["B main"]]
+	require.Equal(t, testTrack{Pid: 42, Name: "G42"}, tracks[slices.Parent])
+	require.Equal(t, trackOf["B main"], trackOf["B bar"])
+}
+
+func TestPerfettoEncoder_args(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewPerfettoEncoder(buf)
+	require.NoError(t, err)
+	g := newTestGoroutine(42, "main")
+	g.Labels = map[string]string{"endpoint": "/users", "id": "1"}
+	g.LockedToThread = true
+	require.NoError(t, e.Encode(1000, nil, g))
+	require.NoError(t, e.Finish())
+
+	var args []string
+	for _, f := range decodeTestProto(t, buf.Bytes()) {
+		ev := decodeTestProto(t, f.Bytes).Message(t, packetFieldTrackEvent)
+		for _, a := range ev.All(trackEventFieldDebugAnnotations) {
+			annotation := decodeTestProto(t, a.Bytes)
+			arg := annotation.String(debugAnnotationFieldName) + ":"
+			for _, d := range annotation.All(debugAnnotationFieldDict) {
+				entry := decodeTestProto(t, d.Bytes)
+				arg += " " + entry.String(debugAnnotationFieldName) + "=" + entry.String(debugAnnotationFieldString)
+			}
+			if v := annotation.All(debugAnnotationFieldBool); len(v) > 0 {
+				arg += " " + strconv.FormatUint(v[0].Value, 10)
+			}
+			args = append(args, arg)
+		}
+	}
+	require.Equal(t, []string{"labels: endpoint=/users id=1", "locked_to_thread: 1"}, args)
+}
+
+func TestPerfettoEncoder_counters(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewPerfettoEncoder(buf)
+	require.NoError(t, err)
+	require.NoError(t, e.Counter(1000, "goroutines", 3))
+	require.NoError(t, e.Counter(1000, "gc_cycles", 1))
+	require.NoError(t, e.Counter(2000, "goroutines", 4))
+	require.NoError(t, e.Finish())
+
+	var (
+		tracks = map[uint64]string{}
+		got    []string
+	)
+	for _, f := range decodeTestProto(t, buf.Bytes()) {
+		packet := decodeTestProto(t, f.Bytes)
+		if desc := packet.Message(t, packetFieldTrackDescriptor); desc != nil {
+			require.Len(t, desc.All(trackDescriptorFieldCounter), 1)
+			tracks[desc.Uint(trackDescriptorFieldUUID)] = desc.String(trackDescriptorFieldName)
+		}
+		if ev := packet.Message(t, packetFieldTrackEvent); ev != nil {
+			require.Equal(t, uint64(trackEventTypeCounter), ev.Uint(trackEventFieldType))
+			value := math.Float64frombits(ev.Uint(trackEventFieldDoubleCounter))
+			got = append(got, fmt.Sprintf("%s=%v @%d", tracks[ev.Uint(trackEventFieldTrackUUID)], value, packet.Uint(packetFieldTimestamp)))
+		}
+	}
+	require.Equal(t, []string{
+		"goroutines=3 @1000000",
+		"gc_cycles=1 @1000000",
+		"goroutines=4 @2000000",
+	}, got)
+}
+
+func TestPerfettoEncoder_runtimeSlice(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewPerfettoEncoder(buf)
+	require.NoError(t, err)
+	require.NoError(t, e.RuntimeSlice(GCTrack, 1000, 50, "GC pause", nil))
+	require.NoError(t, e.Finish())
+
+	var (
+		got    []string
+		tracks = map[uint64]testTrack{}
+	)
+	for _, f := range decodeTestProto(t, buf.Bytes()) {
+		packet := decodeTestProto(t, f.Bytes)
+		if desc := packet.Message(t, packetFieldTrackDescriptor); desc != nil {
+			track := testTrack{Parent: desc.Uint(trackDescriptorFieldParentUUID), Name: desc.String(trackDescriptorFieldName)}
+			if proc := desc.Message(t, trackDescriptorFieldProcess); proc != nil {
+				track.Name = proc.String(processDescriptorFieldProcessName)
+			}
+			tracks[desc.Uint(trackDescriptorFieldUUID)] = track
+		}
+		if ev := packet.Message(t, packetFieldTrackEvent); ev != nil {
+			track := tracks[ev.Uint(trackEventFieldTrackUUID)]
+			got = append(got, fmt.Sprintf("%d %s/%s @%d", ev.Uint(trackEventFieldType), tracks[track.Parent].Name, track.Name, packet.Uint(packetFieldTimestamp)))
+		}
+	}
+	require.Equal(t, []string{
+		fmt.Sprintf("%d runtime/GC @1000000", trackEventTypeSliceBegin),
+		fmt.Sprintf("%d runtime/GC @1050000", trackEventTypeSliceEnd),
+	}, got)
+}
+
+func TestPerfettoEncoder_annotations(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewPerfettoEncoder(buf)
+	require.NoError(t, err)
+	require.NoError(t, e.Region(7, 1000, 50, "query", nil))
+	require.NoError(t, e.Log(7, 1060, "user", nil))
+	require.NoError(t, e.Task(7, 3, 900, 200, "request", nil))
+	require.NoError(t, e.Finish())
+
+	var (
+		got    []string
+		tracks = map[uint64]testTrack{}
+	)
+	for _, f := range decodeTestProto(t, buf.Bytes()) {
+		packet := decodeTestProto(t, f.Bytes)
+		if desc := packet.Message(t, packetFieldTrackDescriptor); desc != nil {
+			track := testTrack{Parent: desc.Uint(trackDescriptorFieldParentUUID), Name: desc.String(trackDescriptorFieldName)}
+			if proc := desc.Message(t, trackDescriptorFieldProcess); proc != nil {
+				track.Pid = proc.Uint(processDescriptorFieldPid)
+			}
+			tracks[desc.Uint(trackDescriptorFieldUUID)] = track
+		}
+		if ev := packet.Message(t, packetFieldTrackEvent); ev != nil {
+			track := tracks[ev.Uint(trackEventFieldTrackUUID)]
+			got = append(got, fmt.Sprintf("%d %d/%s @%d", ev.Uint(trackEventFieldType), tracks[track.Parent].Pid, track.Name, packet.Uint(packetFieldTimestamp)))
+		}
+	}
+	require.Equal(t, []string{
+		fmt.Sprintf("%d 7/annotations @1000000", trackEventTypeSliceBegin),
+		fmt.Sprintf("%d 7/annotations @1050000", trackEventTypeSliceEnd),
+		fmt.Sprintf("%d 7/annotations @1060000", trackEventTypeInstant),
+		fmt.Sprintf("%d 7/request @900000", trackEventTypeSliceBegin),
+		fmt.Sprintf("%d 7/request @1100000", trackEventTypeSliceEnd),
+	}, got)
+}
+
+type testTrack struct {
+	Parent uint64
+	Pid    uint64
+	Name   string
+}
+
+type testProtoField struct {
+	Num   int
+	Value uint64
+	Bytes []byte
+}
+
+type testProtoMessage []testProtoField
+
+func (m testProtoMessage) All(num int) []testProtoField {
+	var fields []testProtoField
+	for _, f := range m {
+		if f.Num == num {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func (m testProtoMessage) Uint(num int) uint64 {
+	for _, f := range m.All(num) {
+		return f.Value
+	}
+	return 0
+}
+
+func (m testProtoMessage) String(num int) string {
+	for _, f := range m.All(num) {
+		return string(f.Bytes)
+	}
+	return ""
+}
+
+func (m testProtoMessage) Message(t *testing.T, num int) testProtoMessage {
+	for _, f := range m.All(num) {
+		return decodeTestProto(t, f.Bytes)
+	}
+	return nil
+}
+
+// decodeTestProto decodes the fields of a protobuf message without knowing its
+// schema.
+func decodeTestProto(t *testing.T, data []byte) testProtoMessage {
+	var m testProtoMessage
+	varint := func() uint64 {
+		var v uint64
+		for shift := 0; ; shift += 7 {
+			require.NotEmpty(t, data)
+			b := data[0]
+			data = data[1:]
+			v |= uint64(b&0x7f) << shift
+			if b < 0x80 {
+				return v
+			}
+		}
+	}
+	for len(data) > 0 {
+		key := varint()
+		f := testProtoField{Num: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.Value = varint()
+		case wireFixed64:
+			require.GreaterOrEqual(t, len(data), 8)
+			for i := 0; i < 8; i++ {
+				f.Value |= uint64(data[i]) << (8 * i)
+			}
+			data = data[8:]
+		case wireBytes:
+			n := int(varint())
+			require.GreaterOrEqual(t, len(data), n)
+			f.Bytes, data = data[:n], data[n:]
+		default:
+			t.Fatalf("unexpected wire type: %d", key&7)
+		}
+		m = append(m, f)
+	}
+	return m
+}
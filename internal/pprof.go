@@ -0,0 +1,292 @@
+package internal
+
+// Implementation of the pprof profile format, see:
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field numbers of the perftools.profiles messages used below.
+const (
+	profileFieldSampleType        = 1
+	profileFieldSample            = 2
+	profileFieldLocation          = 4
+	profileFieldFunction          = 5
+	profileFieldStringTable       = 6
+	profileFieldDurationNanos     = 10
+	profileFieldPeriodType        = 11
+	profileFieldPeriod            = 12
+	profileFieldDefaultSampleType = 14
+
+	valueTypeFieldType = 1
+	valueTypeFieldUnit = 2
+
+	sampleFieldLocationID = 1
+	sampleFieldValue      = 2
+	sampleFieldLabel      = 3
+
+	labelFieldKey = 1
+	labelFieldStr = 2
+
+	locationFieldID   = 1
+	locationFieldLine = 4
+
+	lineFieldFunctionID = 1
+
+	functionFieldID         = 1
+	functionFieldName       = 2
+	functionFieldSystemName = 3
+)
+
+// NewPprofEncoder returns an Encoder that aggregates the wall clock time of
+// the goroutine stacks into a gzipped pprof profile that is written to w when
+// the Encoder is finished.
+func NewPprofEncoder(w io.Writer) (*Encoder, error) {
+	return &Encoder{w: newPprofWriter(w)}, nil
+}
+
+func newPprofWriter(w io.Writer) *pprofWriter {
+	return &pprofWriter{
+		w:          w,
+		funcs:      map[string]uint64{},
+		goroutines: map[int64]*pprofGoroutine{},
+		samples:    map[string]*pprofSample{},
+	}
+}
+
+// pprofWriter reconstructs the stack of each goroutine from the begin and end
+// events and attributes the time between two changes of a stack to it. Each
+// function is represented by a single location. The goroutine id and creator
+// as well as the pprof labels of the begin events are added as sample labels.
+type pprofWriter struct {
+	w          io.Writer
+	hz         int
+	maxTs      float64
+	funcs      map[string]uint64 // func name -> function and location id
+	funcNames  []string          // function id - 1 -> func name
+	goroutines map[int64]*pprofGoroutine
+	samples    map[string]*pprofSample // goroutine id + labels + stack -> sample
+	order      []*pprofSample          // samples in order of creation
+}
+
+// pprofGoroutine is the current state of a goroutine.
+type pprofGoroutine struct {
+	ID        int64
+	CreatedBy string
+	Labels    map[string]string
+	Stack     []uint64 // function ids from root to leaf
+	Since     float64  // ts of the last change of Stack
+}
+
+// pprofSample is the aggregated wall clock time of a goroutine stack.
+type pprofSample struct {
+	Goroutine *pprofGoroutine
+	Labels    map[string]string
+	Stack     []uint64 // function ids from leaf to root
+	Wall      float64  // microseconds
+}
+
+func (p *pprofWriter) WriteEvent(ev *Event) error {
+	switch ev.Ph {
+	case "M":
+		switch ev.Name {
+		case "hz":
+			// The value is an int when written by fgtrace and a float64 when
+			// converting an existing trace.
+			switch hz := ev.Args["hz"].(type) {
+			case int:
+				p.hz = hz
+			case float64:
+				p.hz = int(hz)
+			}
+		case "process_name":
+			// The goroutine name is "G<id>" followed by the creator, see
+			// Encoder.Encode().
+			name, _ := ev.Args["name"].(string)
+			if i := strings.IndexByte(name, ' '); i >= 0 {
+				p.goroutine(ev.Pid).CreatedBy = name[i+1:]
+			}
+		}
+	case "B", "E":
+		// Other tids hold events that are not part of the goroutine stack.
+		if ev.Tid != 1 {
+			return nil
+		}
+		if ev.Ts > p.maxTs {
+			p.maxTs = ev.Ts
+		}
+		g := p.goroutine(ev.Pid)
+		if len(g.Stack) > 0 && ev.Ts > g.Since {
+			p.sample(g).Wall += ev.Ts - g.Since
+		}
+		g.Since = ev.Ts
+		if ev.Ph == "B" {
+			// Every begin event carries the labels the goroutine had when the
+			// frame was sampled, see goroutineArgs().
+			g.Labels = eventLabels(ev)
+			g.Stack = append(g.Stack, p.funcID(ev.Name))
+		} else if len(g.Stack) > 0 {
+			g.Stack = g.Stack[:len(g.Stack)-1]
+		}
+	}
+	return nil
+}
+
+func (p *pprofWriter) goroutine(id int64) *pprofGoroutine {
+	g, ok := p.goroutines[id]
+	if !ok {
+		g = &pprofGoroutine{ID: id}
+		p.goroutines[id] = g
+	}
+	return g
+}
+
+func (p *pprofWriter) funcID(name string) uint64 {
+	id, ok := p.funcs[name]
+	if !ok {
+		p.funcNames = append(p.funcNames, name)
+		id = uint64(len(p.funcNames))
+		p.funcs[name] = id
+	}
+	return id
+}
+
+// sample returns the sample for the current stack of g.
+func (p *pprofWriter) sample(g *pprofGoroutine) *pprofSample {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(g.ID))
+	key := append([]byte(nil), buf[:]...)
+	for _, k := range sortedLabelKeys(g.Labels) {
+		key = append(key, k...)
+		key = append(key, 0)
+		key = append(key, g.Labels[k]...)
+		key = append(key, 0)
+	}
+	for _, id := range g.Stack {
+		binary.LittleEndian.PutUint64(buf[:], id)
+		key = append(key, buf[:]...)
+	}
+	s, ok := p.samples[string(key)]
+	if !ok {
+		s = &pprofSample{Goroutine: g, Labels: g.Labels, Stack: make([]uint64, len(g.Stack))}
+		for i, id := range g.Stack {
+			s.Stack[len(g.Stack)-i-1] = id
+		}
+		p.samples[string(key)] = s
+		p.order = append(p.order, s)
+	}
+	return s
+}
+
+// Finish implements eventWriter by writing the profile.
+func (p *pprofWriter) Finish() error {
+	var (
+		strs    = map[string]int64{"": 0}
+		strList = []string{""}
+		str     = func(s string) int64 {
+			i, ok := strs[s]
+			if !ok {
+				i = int64(len(strList))
+				strs[s] = i
+				strList = append(strList, s)
+			}
+			return i
+		}
+		prof, msg, sub protoBuf
+	)
+
+	valueType := func(field int, typ, unit string) {
+		msg = msg[:0]
+		msg.Int64(valueTypeFieldType, str(typ))
+		msg.Int64(valueTypeFieldUnit, str(unit))
+		prof.Message(field, msg)
+	}
+	valueType(profileFieldSampleType, "wall", "nanoseconds")
+
+	label := func(key, value string) {
+		sub = sub[:0]
+		sub.Int64(labelFieldKey, str(key))
+		sub.Int64(labelFieldStr, str(value))
+		msg.Message(sampleFieldLabel, sub)
+	}
+	for _, s := range p.order {
+		msg = msg[:0]
+		msg.Packed(sampleFieldLocationID, s.Stack)
+		msg.Packed(sampleFieldValue, []uint64{uint64(math.Round(s.Wall * 1000))})
+		label("goroutine", strconv.FormatInt(s.Goroutine.ID, 10))
+		if s.Goroutine.CreatedBy != "" {
+			label("created_by", s.Goroutine.CreatedBy)
+		}
+		for _, k := range sortedLabelKeys(s.Labels) {
+			label(k, s.Labels[k])
+		}
+		prof.Message(profileFieldSample, msg)
+	}
+
+	// Use the same id for the function and location of each func.
+	for i, name := range p.funcNames {
+		id := uint64(i + 1)
+		msg = msg[:0]
+		msg.Uint64(locationFieldID, id)
+		sub = sub[:0]
+		sub.Uint64(lineFieldFunctionID, id)
+		msg.Message(locationFieldLine, sub)
+		prof.Message(profileFieldLocation, msg)
+
+		msg = msg[:0]
+		msg.Uint64(functionFieldID, id)
+		msg.Int64(functionFieldName, str(name))
+		msg.Int64(functionFieldSystemName, str(name))
+		prof.Message(profileFieldFunction, msg)
+	}
+
+	prof.Int64(profileFieldDurationNanos, int64(math.Round(p.maxTs*1000)))
+	valueType(profileFieldPeriodType, "wall", "nanoseconds")
+	if p.hz > 0 {
+		prof.Int64(profileFieldPeriod, int64(1e9/p.hz))
+	}
+	prof.Int64(profileFieldDefaultSampleType, str("wall"))
+	for _, s := range strList {
+		prof.String(profileFieldStringTable, s)
+	}
+
+	gz := gzip.NewWriter(p.w)
+	if _, err := gz.Write(prof); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// eventLabels returns the pprof labels of ev. They are a map[string]string
+// when written by fgtrace and a map[string]interface{} when converting an
+// existing trace.
+func eventLabels(ev *Event) map[string]string {
+	switch v := ev.Args["labels"].(type) {
+	case map[string]string:
+		return v
+	case map[string]interface{}:
+		labels := make(map[string]string, len(v))
+		for k, val := range v {
+			labels[k], _ = val.(string)
+		}
+		return labels
+	default:
+		return nil
+	}
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/gostackparse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPprofEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e, err := NewPprofEncoder(buf)
+	require.NoError(t, err)
+
+	worker := func(stack ...string) *Goroutine {
+		g := newTestGoroutine(42, stack...)
+		g.CreatedBy = &gostackparse.Frame{Func: "main.main"}
+		return g
+	}
+	require.NoError(t, e.CustomMeta("hz", 100))
+	require.NoError(t, e.Encode(0, nil, worker("foo", "main.worker")))
+	require.NoError(t, e.Encode(0, nil, newTestGoroutine(1, "main.main")))
+	labeled := worker("bar", "main.worker")
+	labeled.Labels = map[string]string{"endpoint": "/users"}
+	require.NoError(t, e.Encode(10000, worker("foo", "main.worker"), labeled))
+	require.NoError(t, e.Encode(30000, worker("bar", "main.worker"), nil))
+	require.NoError(t, e.Encode(30000, newTestGoroutine(1, "main.main"), nil))
+	// Events of other tids are not part of the goroutine stacks.
+	require.NoError(t, e.Event(&Event{Name: "region", Ph: "B", Ts: 0, Pid: 1, Tid: 2}))
+	require.NoError(t, e.Finish())
+
+	gz, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	prof := decodeTestProto(t, data)
+
+	var strs []string
+	for _, f := range prof.All(profileFieldStringTable) {
+		strs = append(strs, string(f.Bytes))
+	}
+	require.Equal(t, "", strs[0])
+	str := func(i uint64) string { return strs[i] }
+
+	funcs := map[uint64]string{}
+	for _, f := range prof.All(profileFieldFunction) {
+		fn := decodeTestProto(t, f.Bytes)
+		funcs[fn.Uint(functionFieldID)] = str(fn.Uint(functionFieldName))
+	}
+	locs := map[uint64]string{}
+	for _, f := range prof.All(profileFieldLocation) {
+		loc := decodeTestProto(t, f.Bytes)
+		line := loc.Message(t, locationFieldLine)
+		locs[loc.Uint(locationFieldID)] = funcs[line.Uint(lineFieldFunctionID)]
+	}
+
+	var samples []string
+	for _, f := range prof.All(profileFieldSample) {
+		s := decodeTestProto(t, f.Bytes)
+		var stack []string
+		for _, id := range decodeTestPacked(t, s.All(sampleFieldLocationID)[0].Bytes) {
+			stack = append(stack, locs[id])
+		}
+		desc := strings.Join(stack, ";")
+		for _, v := range decodeTestPacked(t, s.All(sampleFieldValue)[0].Bytes) {
+			desc += " " + strconv.FormatUint(v, 10)
+		}
+		for _, l := range s.All(sampleFieldLabel) {
+			label := decodeTestProto(t, l.Bytes)
+			desc += " " + str(label.Uint(labelFieldKey)) + "=" + str(label.Uint(labelFieldStr))
+		}
+		samples = append(samples, desc)
+	}
+	sort.Strings(samples)
+	require.Equal(t, []string{
+		"bar;main.worker 20000000 goroutine=42 created_by=main.main endpoint=/users",
+		"foo;main.worker 10000000 goroutine=42 created_by=main.main",
+		"main.main 30000000 goroutine=1",
+	}, samples)
+
+	sampleType := prof.Message(t, profileFieldSampleType)
+	require.Equal(t, "wall", str(sampleType.Uint(valueTypeFieldType)))
+	require.Equal(t, "nanoseconds", str(sampleType.Uint(valueTypeFieldUnit)))
+	require.Equal(t, uint64(10000000), prof.Uint(profileFieldPeriod))
+	require.Equal(t, uint64(30000000), prof.Uint(profileFieldDurationNanos))
+}
+
+// decodeTestPacked decodes the values of a packed repeated varint field.
+func decodeTestPacked(t *testing.T, data []byte) []uint64 {
+	var vs []uint64
+	for len(data) > 0 {
+		var v uint64
+		for shift := 0; ; shift += 7 {
+			require.NotEmpty(t, data)
+			b := data[0]
+			data = data[1:]
+			v |= uint64(b&0x7f) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
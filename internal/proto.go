@@ -0,0 +1,84 @@
+package internal
+
+// Minimal implementation of the protobuf wire format, see:
+// https://protobuf.dev/programming-guides/encoding/
+
+import "math"
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// protoBuf is a buffer for encoding protobuf messages. Nested messages are
+// encoded into their own protoBuf and appended using Message().
+type protoBuf []byte
+
+func (b *protoBuf) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *protoBuf) tag(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// Uint64 encodes a uint64, uint32 or enum field.
+func (b *protoBuf) Uint64(field int, v uint64) {
+	b.tag(field, wireVarint)
+	b.varint(v)
+}
+
+// Int64 encodes an int64 or int32 field.
+func (b *protoBuf) Int64(field int, v int64) {
+	b.Uint64(field, uint64(v))
+}
+
+// Bool encodes a bool field.
+func (b *protoBuf) Bool(field int, v bool) {
+	var u uint64
+	if v {
+		u = 1
+	}
+	b.Uint64(field, u)
+}
+
+// Fixed64 encodes a fixed64 field.
+func (b *protoBuf) Fixed64(field int, v uint64) {
+	b.tag(field, wireFixed64)
+	for i := 0; i < 8; i++ {
+		*b = append(*b, byte(v>>(8*i)))
+	}
+}
+
+// Double encodes a double field.
+func (b *protoBuf) Double(field int, v float64) {
+	b.Fixed64(field, math.Float64bits(v))
+}
+
+// String encodes a string field.
+func (b *protoBuf) String(field int, s string) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+// Message encodes a nested message field.
+func (b *protoBuf) Message(field int, msg protoBuf) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(msg)))
+	*b = append(*b, msg...)
+}
+
+// Packed encodes a packed repeated uint64, int64 or enum field.
+func (b *protoBuf) Packed(field int, vs []uint64) {
+	var packed protoBuf
+	for _, v := range vs {
+		packed.varint(v)
+	}
+	b.Message(field, packed)
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileTimeFormat is the format of times in file names.
+const FileTimeFormat = "20060102T150405.000"
+
+// NewRotatingFileWriter returns a RotatingFileWriter that writes to files
+// named after pattern. The placeholders "{seq}" and "{time}" are replaced by
+// the sequence number and start time of each file. If pattern contains
+// neither, "-{seq}" is inserted before its extension. A file is due for
+// rotation once it's older than interval or larger than maxBytes, zero values
+// disable the respective limit. Only the maxFiles most recent files are kept,
+// or all of them if maxFiles is 0. If pattern ends with ".gz", each file is
+// gzip compressed and maxBytes applies to the compressed size. The gzip writer
+// isn't flushed for Due(), which would hurt the compression, so the size only
+// grows when it emits a block and the limit is approximate.
+func NewRotatingFileWriter(pattern string, interval time.Duration, maxBytes int64, maxFiles int) *RotatingFileWriter {
+	if !strings.Contains(pattern, "{seq}") && !strings.Contains(pattern, "{time}") {
+		ext := filepath.Ext(pattern)
+		if ext == ".gz" {
+			ext = filepath.Ext(strings.TrimSuffix(pattern, ext)) + ext
+		}
+		pattern = strings.TrimSuffix(pattern, ext) + "-{seq}" + ext
+	}
+	return &RotatingFileWriter{
+		pattern:  pattern,
+		interval: interval,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+		compress: strings.HasSuffix(pattern, ".gz"),
+		seq:      1,
+	}
+}
+
+// RotatingFileWriter is an io.WriteCloser that writes to a sequence of files.
+// It doesn't know about the format of the data, so the caller is responsible
+// for calling Rotate() when Due() returns true and for making each file valid
+// on its own. Like the writer returned by NewFileWriter(), files are created on
+// the first write.
+type RotatingFileWriter struct {
+	pattern  string
+	interval time.Duration
+	maxBytes int64
+	maxFiles int
+	compress bool // gzip compress the files
+
+	seq   int          // sequence number of the current file
+	start time.Time    // start time of the current file
+	file  *os.File     // current file, nil before the first write
+	gz    *gzip.Writer // compresses into the current file if compress is set
+	bytes int64        // bytes written to the current file
+	names []string     // names of the files that have been created, oldest first
+	err   error
+}
+
+// Begin sets the start time of the first file to now.
+func (r *RotatingFileWriter) Begin(now time.Time) {
+	r.start = now
+}
+
+// Write implements io.Writer.
+func (r *RotatingFileWriter) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.file == nil {
+		name := r.name()
+		if r.file, r.err = os.Create(name); r.err != nil {
+			return 0, r.err
+		}
+		r.names = append(r.names, name)
+		if r.err = r.prune(); r.err != nil {
+			return 0, r.err
+		}
+		if r.compress {
+			r.gz = gzip.NewWriter(fileCounter{r})
+		}
+	}
+	if r.gz != nil {
+		return r.gz.Write(p)
+	}
+	return fileCounter{r}.Write(p)
+}
+
+// fileCounter writes to the current file of a RotatingFileWriter and counts
+// the bytes written to it.
+type fileCounter struct{ r *RotatingFileWriter }
+
+// Write implements io.Writer.
+func (c fileCounter) Write(p []byte) (int, error) {
+	n, err := c.r.file.Write(p)
+	c.r.bytes += int64(n)
+	return n, err
+}
+
+// Due returns true if the current file has reached its max age at now or its
+// max size. For compressed files the size doesn't include the data buffered
+// by the gzip writer.
+func (r *RotatingFileWriter) Due(now time.Time) bool {
+	return (r.interval > 0 && now.Sub(r.start) >= r.interval) ||
+		(r.maxBytes > 0 && r.bytes >= r.maxBytes)
+}
+
+// Rotate closes the current file and directs the following writes to a new
+// file that is started at now.
+func (r *RotatingFileWriter) Rotate(now time.Time) error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	r.seq++
+	r.start = now
+	r.bytes = 0
+	return nil
+}
+
+// Close implements io.Closer.
+func (r *RotatingFileWriter) Close() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	return r.err
+}
+
+func (r *RotatingFileWriter) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	var err error
+	if r.gz != nil {
+		err = r.gz.Close()
+		r.gz = nil
+	}
+	if closeErr := r.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
+
+// name returns the name of the current file.
+func (r *RotatingFileWriter) name() string {
+	return strings.NewReplacer(
+		"{seq}", fmt.Sprintf("%06d", r.seq),
+		"{time}", r.start.Format(FileTimeFormat),
+	).Replace(r.pattern)
+}
+
+// prune removes the oldest files that exceed maxFiles.
+func (r *RotatingFileWriter) prune() error {
+	for r.maxFiles > 0 && len(r.names) > r.maxFiles {
+		if err := os.Remove(r.names[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.names = r.names[1:]
+	}
+	return nil
+}
+
+// String implements fmt.Stringer.
+func (r *RotatingFileWriter) String() string {
+	return r.pattern
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFileWriter(t *testing.T) {
+	t.Run("pattern", func(t *testing.T) {
+		start := time.Date(2022, 6, 1, 15, 4, 5, 0, time.UTC)
+		r := NewRotatingFileWriter("trace-{time}.json", 0, 0, 0)
+		r.Begin(start)
+		require.Equal(t, "trace-20220601T150405.000.json", r.name())
+
+		r = NewRotatingFileWriter("trace.json", 0, 0, 0)
+		require.Equal(t, "trace-000001.json", r.name())
+
+		r = NewRotatingFileWriter("trace.json.gz", 0, 0, 0)
+		require.Equal(t, "trace-000001.json.gz", r.name())
+	})
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		dir := t.TempDir()
+		now := time.Now()
+		r := NewRotatingFileWriter(filepath.Join(dir, "{seq}.txt"), time.Hour, 5, 0)
+		r.Begin(now)
+		require.False(t, r.Due(now))
+
+		_, err := r.Write([]byte("Hello "))
+		require.NoError(t, err)
+		require.True(t, r.Due(now))
+		require.NoError(t, r.Rotate(now))
+		require.False(t, r.Due(now))
+		require.True(t, r.Due(now.Add(time.Hour)))
+
+		_, err = r.Write([]byte("World"))
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+
+		for name, want := range map[string]string{"000001.txt": "Hello ", "000002.txt": "World"} {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err)
+			require.Equal(t, want, string(data))
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		dir := t.TempDir()
+		now := time.Now()
+		r := NewRotatingFileWriter(filepath.Join(dir, "{seq}.txt.gz"), 0, 0, 0)
+		r.Begin(now)
+		_, err := r.Write([]byte("Hello "))
+		require.NoError(t, err)
+		require.NoError(t, r.Rotate(now))
+		_, err = r.Write([]byte("World"))
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+
+		for name, want := range map[string]string{"000001.txt.gz": "Hello ", "000002.txt.gz": "World"} {
+			f, err := os.Open(filepath.Join(dir, name))
+			require.NoError(t, err)
+			defer f.Close()
+			gr, err := gzip.NewReader(f)
+			require.NoError(t, err)
+			data, err := io.ReadAll(gr)
+			require.NoError(t, err)
+			require.Equal(t, want, string(data))
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package fgtrace
+
+import (
+	"math"
+	"runtime/metrics"
+)
+
+// runtimeMetrics maps the runtime/metrics read by Config.Metrics to the names
+// of their counter tracks.
+var runtimeMetrics = []struct {
+	Name    string // runtime/metrics name
+	Counter string // counter track name
+}{
+	{"/sched/goroutines:goroutines", "goroutines"},
+	{"/memory/classes/heap/objects:bytes", "heap_objects_bytes"},
+	{"/gc/cycles/total:gc-cycles", "gc_cycles"},
+	{"/sched/gomaxprocs:threads", "gomaxprocs"},
+	{"/sched/latencies:seconds", "sched_latency_p99_us"},
+}
+
+// samplerSTWCounter is the name of the counter track for the time it took to
+// capture the goroutines of a sample. For NewStackProfiler() this is the time
+// the world was stopped by the sampler.
+const samplerSTWCounter = "sampler_stw_us"
+
+// counter is the value of a counter track at the time of a sample.
+type counter struct {
+	Name  string
+	Value float64
+}
+
+// newMetricsReader returns a metricsReader for runtimeMetrics.
+func newMetricsReader() *metricsReader {
+	r := &metricsReader{samples: make([]metrics.Sample, len(runtimeMetrics))}
+	for i, m := range runtimeMetrics {
+		r.samples[i].Name = m.Name
+	}
+	return r
+}
+
+// metricsReader reads runtimeMetrics for the samples of a trace.
+type metricsReader struct {
+	samples []metrics.Sample
+	prev    map[string]*metrics.Float64Histogram // histograms of the last read
+}
+
+// read returns the current value of runtimeMetrics. Metrics that are not
+// supported by the runtime are skipped. Histograms are reported as the 99th
+// percentile of the values observed since the previous read, so they are
+// skipped by the first read.
+func (r *metricsReader) read() []counter {
+	metrics.Read(r.samples)
+	counters := make([]counter, 0, len(r.samples))
+	prev := r.prev
+	r.prev = map[string]*metrics.Float64Histogram{}
+	for i, s := range r.samples {
+		name := runtimeMetrics[i].Counter
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			counters = append(counters, counter{name, float64(s.Value.Uint64())})
+		case metrics.KindFloat64:
+			counters = append(counters, counter{name, s.Value.Float64()})
+		case metrics.KindFloat64Histogram:
+			// The histogram is reused by the next call to metrics.Read(), so it
+			// has to be copied.
+			h := s.Value.Float64Histogram()
+			copied := &metrics.Float64Histogram{
+				Counts:  append([]uint64(nil), h.Counts...),
+				Buckets: h.Buckets,
+			}
+			r.prev[name] = copied
+			if p := prev[name]; p != nil {
+				counters = append(counters, counter{name, percentile(p, copied, 0.99) * 1e6})
+			}
+		}
+	}
+	return counters
+}
+
+// percentile returns the upper bound of the bucket containing the given
+// percentile of the values that were added to cur since prev, or 0 if no
+// values were added.
+func percentile(prev, cur *metrics.Float64Histogram, p float64) float64 {
+	var total uint64
+	for i, c := range cur.Counts {
+		total += c - prev.Counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+	var (
+		rank = uint64(math.Ceil(p * float64(total)))
+		sum  uint64
+	)
+	for i, c := range cur.Counts {
+		sum += c - prev.Counts[i]
+		if sum < rank {
+			continue
+		} else if upper := cur.Buckets[i+1]; !math.IsInf(upper, 1) {
+			return upper
+		}
+		return cur.Buckets[i]
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+package fgtrace
+
+import (
+	"math"
+	"runtime/metrics"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_percentile(t *testing.T) {
+	buckets := []float64{0, 1, 2, 3, math.Inf(1)}
+	prev := &metrics.Float64Histogram{Counts: []uint64{5, 5, 5, 5}, Buckets: buckets}
+
+	cur := &metrics.Float64Histogram{Counts: []uint64{5, 5, 5, 5}, Buckets: buckets}
+	require.Equal(t, float64(0), percentile(prev, cur, 0.99))
+
+	cur = &metrics.Float64Histogram{Counts: []uint64{103, 5, 7, 5}, Buckets: buckets}
+	require.Equal(t, float64(1), percentile(prev, cur, 0.98))
+	require.Equal(t, float64(3), percentile(prev, cur, 0.99))
+
+	// The upper bound of the last bucket is infinite, so its lower bound is
+	// used instead.
+	cur = &metrics.Float64Histogram{Counts: []uint64{5, 5, 5, 6}, Buckets: buckets}
+	require.Equal(t, float64(3), percentile(prev, cur, 0.99))
+}
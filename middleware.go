@@ -0,0 +1,180 @@
+package fgtrace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	defaultRequestIDHeader      = "X-Request-Id"
+	defaultRequestMaxConcurrent = 1
+)
+
+// RequestConfig configures a middleware that traces individual HTTP
+// requests, see Middleware(). Unlike Config.ServeHTTP(), which traces the
+// whole process, the trace of a request only contains the goroutine handling
+// it and the goroutines it starts while doing so, see Config.CallerTree for
+// the limitations. The zero value is a valid configuration that traces no
+// requests.
+type RequestConfig struct {
+	// Config configures the traces. Its Dst is ignored in favor of the Dst of
+	// the RequestConfig, flight recorder mode (see Config.Window) and
+	// ExecutionTrace are not supported and CallerTree is always enabled.
+	Config Config
+	// SampleRate is the fraction of requests that are traced at random, e.g.
+	// 0.01 for 1%. Zero disables sampling.
+	SampleRate float64
+	// Header causes requests that set the header with the given name to a true
+	// value, see strconv.ParseBool(), to be traced, e.g. "X-Fgtrace: 1". It's
+	// disabled if it is "". Every traced request stops the world at
+	// Config.Hz, so the header should only be enabled for trusted clients.
+	Header string
+	// MaxConcurrent limits the number of requests that are traced at the same
+	// time. Requests selected while the limit is reached are not traced.
+	// WithDefaults() sets it to 1 if it is 0, a negative value disables it.
+	MaxConcurrent int
+	// RequestID returns the id of a request, which is used in log messages and
+	// as the id of the trace of requests selected by Header. WithDefaults()
+	// sets it to a func that returns the "X-Request-Id" header of the request,
+	// or a random id if it is missing, if it is nil.
+	RequestID func(r *http.Request) string
+	// Dst returns the destination for the trace with the given id. The id of
+	// the trace is the request id for requests selected by Header and a random
+	// id for requests selected by SampleRate, so clients can't choose the
+	// destination of traces they didn't ask for, e.g. to overwrite other
+	// traces. WithDefaults() sets it to a func that creates files named after
+	// the id in the current directory, e.g. "fgtrace-request-<id>.json", if it
+	// is nil.
+	Dst func(id string) io.WriteCloser
+	// Link returns the URL the trace with the given id, see Dst, can be
+	// downloaded from, e.g. via an http.FileServer() for the files written by
+	// Dst. If it is not nil, the URL is returned to the client in a
+	// `Link: <url>; rel="fgtrace"` response header of traced requests.
+	Link func(id string) string
+	// Logf is called with a message after every trace, e.g. log.Printf. No
+	// messages are logged if it is nil.
+	Logf func(format string, args ...interface{})
+}
+
+// WithDefaults returns a copy of c with default values applied as described
+// in the type documentation. This is done automatically by Middleware().
+func (c RequestConfig) WithDefaults() RequestConfig {
+	c.Config = c.Config.WithDefaults()
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = defaultRequestMaxConcurrent
+	}
+	if c.RequestID == nil {
+		c.RequestID = func(r *http.Request) string {
+			if id := r.Header.Get(defaultRequestIDHeader); id != "" {
+				return id
+			}
+			return randomID()
+		}
+	}
+	if c.Dst == nil {
+		ext := ".json"
+		switch c.Config.Format {
+		case FormatPerfetto:
+			ext = ".pftrace"
+		case FormatPprof:
+			ext = ".pprof"
+		}
+		c.Dst = func(id string) io.WriteCloser {
+			return File("fgtrace-request-" + safeFileName(id) + ext)
+		}
+	}
+	return c
+}
+
+// Middleware applies WithDefaults to c and returns an http.Handler that calls
+// next and traces the requests selected by c.SampleRate or c.Header. The trace
+// of a request starts before next is called and ends when it returns.
+func (c RequestConfig) Middleware(next http.Handler) http.Handler {
+	c = c.WithDefaults()
+	var running int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selected, byHeader := c.selected(r)
+		if !selected {
+			next.ServeHTTP(w, r)
+			return
+		} else if n := atomic.AddInt32(&running, 1); c.MaxConcurrent > 0 && int(n) > c.MaxConcurrent {
+			atomic.AddInt32(&running, -1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer atomic.AddInt32(&running, -1)
+
+		id := c.RequestID(r)
+		traceID := randomID()
+		if byHeader {
+			traceID = id
+		}
+		if c.Link != nil {
+			w.Header().Add("Link", "<"+c.Link(traceID)+`>; rel="fgtrace"`)
+		}
+		conf := c.Config
+		conf.Dst = c.Dst(traceID)
+		conf.Window, conf.WindowBytes = 0, 0
+		conf.CallerTree = true
+		conf.ExecutionTrace = nil
+		trace := conf.Trace()
+		next.ServeHTTP(w, r)
+		err := trace.Stop()
+		c.logTrace(conf.Dst, id, err)
+	})
+}
+
+// selected returns true if r should be traced, and if it was selected by
+// c.Header rather than c.SampleRate.
+func (c RequestConfig) selected(r *http.Request) (ok, byHeader bool) {
+	if c.Header != "" {
+		if ok, _ := strconv.ParseBool(r.Header.Get(c.Header)); ok {
+			return true, true
+		}
+	}
+	return c.SampleRate > 0 && mrand.Float64() < math.Min(c.SampleRate, 1), false
+}
+
+// logTrace reports the result of the trace of the request with the given id
+// via Logf.
+func (c RequestConfig) logTrace(dst io.WriteCloser, id string, err error) {
+	if c.Logf == nil {
+		return
+	} else if err != nil {
+		c.Logf("fgtrace: request %s: failed to write trace to %v: %s", id, dst, err)
+		return
+	}
+	c.Logf("fgtrace: request %s: wrote trace to %v", id, dst)
+}
+
+// randomID returns a random hex encoded id.
+func randomID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// maxFileNameID is the max length of an id in a file name, see safeFileName().
+const maxFileNameID = 64
+
+// safeFileName replaces the characters of name that are not letters, digits,
+// '-', '_' or '.' with '_', so an id taken from a request can't add path
+// separators to a file name, and truncates it to maxFileNameID bytes.
+func safeFileName(name string) string {
+	if len(name) > maxFileNameID {
+		name = name[:maxFileNameID]
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,158 @@
+package fgtrace
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixge/fgtrace/internal"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func ExampleRequestConfig_Middleware() {
+	// Trace 1% of all requests as well as the ones sent with "X-Fgtrace: 1"
+	// and tell the client where to find the trace.
+	traces := RequestConfig{
+		SampleRate: 0.01,
+		Header:     "X-Fgtrace",
+		Link:       func(id string) string { return "/debug/fgtrace/fgtrace-request-" + id + ".json" },
+	}
+	http.Handle("/debug/fgtrace/", http.StripPrefix("/debug/fgtrace/", http.FileServer(http.Dir("."))))
+	http.Handle("/", traces.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// <handle request>
+	})))
+}
+
+func TestRequestConfig_Middleware(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	// pids returns the ids of the goroutines with stacks in the trace.
+	pids := func(t *testing.T, buf *bytes.Buffer) map[int]bool {
+		data, err := internal.Unmarshal(buf.Bytes())
+		require.NoError(t, err)
+		pids := map[int]bool{}
+		for _, e := range data.Events {
+			if e.Ph == "B" {
+				pids[int(e.Pid)] = true
+			}
+		}
+		return pids
+	}
+
+	t.Run("Header", func(t *testing.T) {
+		// An unrelated goroutine that exists during the request.
+		unrelatedID, unblock := make(chan int), make(chan struct{})
+		go func() {
+			unrelatedID <- curGoroutineID()
+			<-unblock
+		}()
+		defer close(unblock)
+		unrelated := <-unrelatedID
+
+		dst := newTestRequestTraces()
+		var handler, child int
+		h := RequestConfig{
+			Config: Config{Hz: 1000},
+			Header: "X-Fgtrace",
+			Dst:    dst.Dst,
+			Link:   func(id string) string { return "/traces/" + id },
+		}.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler = curGoroutineID()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				child = curGoroutineID()
+				time.Sleep(20 * time.Millisecond)
+			}()
+			<-done
+			io.WriteString(w, "hello")
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Fgtrace", "1")
+		req.Header.Set("X-Request-Id", "abc")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		require.Equal(t, "hello", rec.Body.String())
+		require.Equal(t, `</traces/abc>; rel="fgtrace"`, rec.Header().Get("Link"))
+		require.Equal(t, []string{"abc"}, dst.ids)
+		// Older Go versions don't report the creator of the child, so it's
+		// not part of the trace.
+		want := map[int]bool{handler: true}
+		if hasCreatorIDs() {
+			want[child] = true
+		}
+		require.Equal(t, want, pids(t, dst.bufs["abc"]))
+		require.NotEqual(t, unrelated, handler)
+
+		// Requests without the header are not traced.
+		req.Header.Del("X-Fgtrace")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		require.Len(t, dst.ids, 1)
+	})
+
+	t.Run("SampleRate", func(t *testing.T) {
+		dst := newTestRequestTraces()
+		h := RequestConfig{SampleRate: 1, Header: "X-Fgtrace", Dst: dst.Dst}.Middleware(http.NotFoundHandler())
+		// The request id can't be used to choose the trace of a sampled
+		// request.
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-Id", "abc")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		require.Len(t, dst.ids, 1)
+		require.Len(t, dst.ids[0], 16)
+		require.NotEqual(t, "abc", dst.ids[0])
+		require.Equal(t, map[int]bool{curGoroutineID(): true}, pids(t, dst.bufs[dst.ids[0]]))
+	})
+
+	t.Run("MaxConcurrent", func(t *testing.T) {
+		dst := newTestRequestTraces()
+		var h http.Handler
+		nested := 0
+		h = RequestConfig{SampleRate: 1, Dst: dst.Dst}.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if nested++; nested == 1 {
+				// The limit of 1 is reached while this request is traced.
+				h.ServeHTTP(w, r)
+			}
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		require.Equal(t, 2, nested)
+		require.Len(t, dst.ids, 1)
+	})
+
+	t.Run("Dst", func(t *testing.T) {
+		dst := RequestConfig{}.WithDefaults().Dst("../a b")
+		require.Equal(t, "fgtrace-request-.._a_b.json", fmt.Sprint(dst))
+		dst = RequestConfig{Config: Config{Format: FormatPerfetto}}.WithDefaults().Dst("abc")
+		require.Equal(t, "fgtrace-request-abc.pftrace", fmt.Sprint(dst))
+		dst = RequestConfig{}.WithDefaults().Dst(strings.Repeat("a", 1000))
+		require.Equal(t, "fgtrace-request-"+strings.Repeat("a", maxFileNameID)+".json", fmt.Sprint(dst))
+	})
+}
+
+// testRequestTraces collects the traces written by a RequestConfig.
+type testRequestTraces struct {
+	mu   sync.Mutex
+	ids  []string
+	bufs map[string]*bytes.Buffer
+}
+
+func newTestRequestTraces() *testRequestTraces {
+	return &testRequestTraces{bufs: map[string]*bytes.Buffer{}}
+}
+
+func (d *testRequestTraces) Dst(id string) io.WriteCloser {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ids = append(d.ids, id)
+	d.bufs[id] = &bytes.Buffer{}
+	return Writer(d.bufs[id])
+}
@@ -0,0 +1,73 @@
+package fgtrace
+
+import (
+	"time"
+
+	"github.com/felixge/fgtrace/internal"
+)
+
+// runtimeSlice is a slice on one of the tracks of the "runtime" process, see
+// internal.RuntimeTrack.
+type runtimeSlice struct {
+	Track internal.RuntimeTrack
+	Name  string
+	Ts    float64 // microseconds since the start of the trace
+	Dur   float64 // microseconds
+	Args  map[string]interface{}
+}
+
+// overhead accounts for the time a trace spends capturing and encoding its
+// samples for Config.Overhead.
+type overhead struct {
+	interval   time.Duration // configured time between two ticks
+	lastTick   time.Time     // time of the last tick, or the start of the trace
+	ticks      int           // number of ticks received
+	missed     int           // number of ticks dropped by the ticker
+	samples    int           // number of samples taken
+	sampler    time.Duration // total time spent in Profiler.Goroutines()
+	maxSampler time.Duration // longest call to Profiler.Goroutines()
+	encode     time.Duration // total time spent filtering and encoding samples
+}
+
+// tick records the tick received at now. Tickers drop ticks when the receiver
+// falls behind, so gaps of more than 1.5 intervals count as missed ticks.
+func (o *overhead) tick(now time.Time) {
+	gap := now.Sub(o.lastTick)
+	if gap > o.interval*3/2 {
+		o.missed += int((gap+o.interval/2)/o.interval) - 1
+	}
+	o.lastTick = now
+	o.ticks++
+}
+
+// sample records the time d it took to capture the goroutines of a sample.
+func (o *overhead) sample(d time.Duration) {
+	o.samples++
+	o.sampler += d
+	if d > o.maxSampler {
+		o.maxSampler = d
+	}
+}
+
+// summary returns the summary of the overhead for a trace that was stopped
+// after the given duration.
+func (o *overhead) summary(hz int, elapsed time.Duration) map[string]interface{} {
+	achievedHz := 0.0
+	if elapsed > 0 {
+		achievedHz = float64(o.ticks) / elapsed.Seconds()
+	}
+	return map[string]interface{}{
+		"samples":        o.samples,
+		"sampler_us":     durationUs(o.sampler),
+		"max_sampler_us": durationUs(o.maxSampler),
+		"encode_us":      durationUs(o.encode),
+		"hz":             hz,
+		"achieved_hz":    achievedHz,
+		"missed_ticks":   o.missed,
+	}
+}
+
+// durationUs returns d in microseconds, the unit of trace timestamps.
+func durationUs(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1e3
+}
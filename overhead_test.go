@@ -0,0 +1,26 @@
+package fgtrace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_overhead(t *testing.T) {
+	start := time.Now()
+	o := &overhead{interval: 10 * time.Millisecond, lastTick: start}
+	o.tick(start.Add(10 * time.Millisecond))
+	o.tick(start.Add(24 * time.Millisecond))
+	// 2 ticks were dropped by the ticker
+	o.tick(start.Add(51 * time.Millisecond))
+	o.sample(2 * time.Millisecond)
+	o.sample(5 * time.Millisecond)
+
+	summary := o.summary(100, 60*time.Millisecond)
+	require.Equal(t, 2, summary["missed_ticks"])
+	require.Equal(t, 2, summary["samples"])
+	require.Equal(t, float64(7000), summary["sampler_us"])
+	require.Equal(t, float64(5000), summary["max_sampler_us"])
+	require.InDelta(t, 50, summary["achieved_hz"], 0.001)
+}
@@ -0,0 +1,353 @@
+package fgtrace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/gostackparse"
+	"github.com/felixge/fgtrace/internal"
+)
+
+// Goroutine is a snapshot of a single goroutine taken by a Profiler.
+type Goroutine = internal.Goroutine
+
+// Profiler captures the goroutines of the current process. A trace calls
+// Goroutines() once per sample from a single goroutine. Profilers that are
+// shared by concurrent traces, e.g. a Config.Profiler used by ServeHTTP(),
+// must be safe for concurrent use.
+type Profiler interface {
+	// Goroutines returns the current goroutines with their stacks ordered from
+	// leaf to root frame. The caller takes ownership of the returned goroutines
+	// and may modify them, but not the frames they point to.
+	Goroutines() ([]*Goroutine, error)
+}
+
+// NewStackProfiler returns a Profiler that captures the goroutines by calling
+// runtime.Stack() and parsing its text output. It provides goroutine ids,
+// states, creators (including their goroutine id since Go 1.21) and, since Go
+// 1.27, pprof labels, but the stop-the-world pause of runtime.Stack() as well
+// as the parsing scales poorly to large numbers of goroutines.
+func NewStackProfiler() Profiler {
+	return &stackProfiler{}
+}
+
+type stackProfiler struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (p *stackProfiler) Goroutines() ([]*Goroutine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.buf == nil {
+		p.buf = make([]byte, 16*1024)
+	}
+	for {
+		n := runtime.Stack(p.buf, true)
+		if n < len(p.buf) {
+			stack, labels := stripLabels(p.buf[:n])
+			gs, errs := gostackparse.Parse(bytes.NewReader(stack))
+			goroutines := make([]*Goroutine, len(gs))
+			for i, g := range gs {
+				goroutines[i] = &Goroutine{Goroutine: *g, Labels: labels[g.ID]}
+				goroutines[i].CreatedByID = stripCreatedByID(g.CreatedBy)
+			}
+			if len(errs) > 0 {
+				return goroutines, errs[0]
+			}
+			return goroutines, nil
+		}
+		p.buf = make([]byte, 2*len(p.buf))
+	}
+}
+
+var (
+	goroutinePrefix = []byte("goroutine ")
+	labelsStart     = []byte("] {")
+)
+
+// stripLabels removes the pprof labels that runtime.Stack() appends to the
+// goroutine headers since Go 1.27 (GODEBUG=tracebacklabels=1), e.g.
+// `goroutine 7 [select] {endpoint: "/users", id: 42}:`, because gostackparse
+// rejects such headers. It returns the remaining stack and the labels by
+// goroutine id. Headers with labels that can't be parsed are left alone.
+func stripLabels(stack []byte) ([]byte, map[int]map[string]string) {
+	if !bytes.Contains(stack, labelsStart) {
+		return stack, nil
+	}
+
+	var (
+		out    = make([]byte, 0, len(stack))
+		labels = map[int]map[string]string{}
+	)
+	for len(stack) > 0 {
+		line := stack
+		if i := bytes.IndexByte(stack, '\n'); i >= 0 {
+			line, stack = stack[:i+1], stack[i+1:]
+		} else {
+			stack = nil
+		}
+
+		header := bytes.TrimSuffix(line, []byte("\n"))
+		if start := bytes.Index(header, labelsStart); start >= 0 && bytes.HasPrefix(header, goroutinePrefix) {
+			idEnd := bytes.IndexByte(header[len(goroutinePrefix):], ' ')
+			id, err := strconv.Atoi(string(header[len(goroutinePrefix) : len(goroutinePrefix)+idEnd]))
+			if gl, ok := parseLabels(header[start+len(labelsStart):]); ok && err == nil {
+				labels[id] = gl
+				out = append(out, header[:start+1]...)
+				out = append(out, ":\n"...)
+				continue
+			}
+		}
+		out = append(out, line...)
+	}
+	return out, labels
+}
+
+// parseLabels parses the labels of a goroutine header following the opening
+// brace, e.g. `endpoint: "/users", id: 42}:`.
+func parseLabels(s []byte) (map[string]string, bool) {
+	labels := map[string]string{}
+	for {
+		key, rest, ok := parseLabelString(s)
+		if !ok || !bytes.HasPrefix(rest, []byte(": ")) {
+			return nil, false
+		}
+		val, rest, ok := parseLabelString(rest[2:])
+		if !ok {
+			return nil, false
+		}
+		labels[key] = val
+		if bytes.HasPrefix(rest, []byte(", ")) {
+			s = rest[2:]
+			continue
+		}
+		return labels, string(rest) == "}:"
+	}
+}
+
+// parseLabelString parses a label key or value at the beginning of s. The
+// runtime quotes them if they contain characters other than letters, digits,
+// '.', '/' and '_'.
+func parseLabelString(s []byte) (string, []byte, bool) {
+	if len(s) > 0 && s[0] == '"' {
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				val, err := strconv.Unquote(string(s[:i+1]))
+				return val, s[i+1:], err == nil
+			}
+		}
+		return "", nil, false
+	}
+	i := 0
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z' || s[i] >= '0' && s[i] <= '9' || s[i] == '.' || s[i] == '/' || s[i] == '_') {
+		i++
+	}
+	return string(s[:i]), s[i:], true
+}
+
+var createdByIDPrefix = " in goroutine "
+
+// stripCreatedByID removes the id of the creating goroutine that
+// runtime.Stack() appends to the creator function since Go 1.21, e.g.
+// "main.main in goroutine 1", from f and returns it. It returns 0 if f has no
+// such suffix.
+func stripCreatedByID(f *gostackparse.Frame) int {
+	if f == nil {
+		return 0
+	}
+	i := strings.LastIndex(f.Func, createdByIDPrefix)
+	if i < 0 {
+		return 0
+	}
+	id, err := strconv.Atoi(f.Func[i+len(createdByIDPrefix):])
+	if err != nil {
+		return 0
+	}
+	f.Func = f.Func[:i]
+	return id
+}
+
+// NewRecordProfiler returns a Profiler that captures the goroutines by calling
+// runtime.GoroutineProfile() and symbolizing the stacks with
+// runtime.CallersFrames(). This avoids the text round trip of
+// NewStackProfiler() and doesn't stop the world for the full duration of the
+// capture, but comes with limitations:
+//
+//   - The runtime doesn't report goroutine ids, so the ids are approximate:
+//     each goroutine gets the id of the goroutine with the most similar stack
+//     in the previous sample. When goroutines start, exit or change their
+//     stacks between samples, ids can move to a different goroutine, and its
+//     slices, flow events and labels are then attributed to the wrong one.
+//     The begin events of all slices have an "approximate_id" arg that is
+//     true, see Goroutine.ApproximateID.
+//   - States, creators and pprof labels are not reported, so no state frames
+//     are added and Config.CallerTree can't be used, Trace.Stop() returns an
+//     error for it.
+//   - Stacks are truncated to 32 frames.
+func NewRecordProfiler() Profiler {
+	return &recordProfiler{}
+}
+
+type recordProfiler struct {
+	mu      sync.Mutex
+	records []runtime.StackRecord
+	frames  map[string][]*gostackparse.Frame // stack key -> symbolized frames
+	prev    []recordGoroutine                // goroutines of the previous call
+	nextID  int                              // last synthesized goroutine id
+}
+
+// recordGoroutine is a goroutine remembered by recordProfiler for assigning
+// ids in the next call.
+type recordGoroutine struct {
+	ID    int
+	Stack []*gostackparse.Frame
+}
+
+func (p *recordProfiler) Goroutines() ([]*Goroutine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n, ok := runtime.GoroutineProfile(p.records)
+	for !ok {
+		p.records = make([]runtime.StackRecord, n+n/10+10)
+		n, ok = runtime.GoroutineProfile(p.records)
+	}
+
+	// Symbolize the stacks, reusing the frames of the previous call for
+	// identical stacks. Frames are never modified, so sharing them is fine.
+	frames := make(map[string][]*gostackparse.Frame, len(p.frames))
+	goroutines := make([]*Goroutine, n)
+	for i, r := range p.records[:n] {
+		pcs := r.Stack()
+		key := stackKey(pcs)
+		stack, ok := frames[key]
+		if !ok {
+			if stack, ok = p.frames[key]; !ok {
+				stack = symbolize(pcs)
+			}
+			frames[key] = stack
+		}
+		// Clip the capacity so appending state frames doesn't modify the stacks
+		// of other goroutines.
+		stack = stack[:len(stack):len(stack)]
+		goroutines[i] = &Goroutine{Goroutine: gostackparse.Goroutine{Stack: stack}, ApproximateID: true}
+	}
+	p.frames = frames
+
+	p.assignIDs(goroutines)
+	p.prev = p.prev[:0]
+	for _, g := range goroutines {
+		p.prev = append(p.prev, recordGoroutine{ID: g.ID, Stack: g.Stack})
+	}
+	return goroutines, nil
+}
+
+// assignIDs assigns the ids of the goroutines of the previous call to the
+// goroutines with the most similar stacks and new ids to the remaining ones.
+func (p *recordProfiler) assignIDs(goroutines []*Goroutine) {
+	// Goroutines with identical stacks are matched first, which should cover
+	// most goroutines as most of them are usually blocked.
+	byStack := make(map[string][]int, len(p.prev))
+	for _, g := range p.prev {
+		key := stackFuncKey(g.Stack)
+		byStack[key] = append(byStack[key], g.ID)
+	}
+	var unmatched []*Goroutine
+	for _, g := range goroutines {
+		key := stackFuncKey(g.Stack)
+		if ids := byStack[key]; len(ids) > 0 {
+			g.ID, byStack[key] = ids[0], ids[1:]
+		} else {
+			unmatched = append(unmatched, g)
+		}
+	}
+	if len(unmatched) == 0 {
+		return
+	}
+
+	// Match the remaining goroutines to the remaining goroutines of the
+	// previous call with the longest common root.
+	available := make(map[int]bool)
+	for _, ids := range byStack {
+		for _, id := range ids {
+			available[id] = true
+		}
+	}
+	var candidates []recordGoroutine
+	for _, g := range p.prev {
+		if available[g.ID] {
+			candidates = append(candidates, g)
+		}
+	}
+	for _, g := range unmatched {
+		best, bestDepth := -1, 0
+		for i, c := range candidates {
+			if depth := commonRootDepth(g.Stack, c.Stack); depth > bestDepth {
+				best, bestDepth = i, depth
+			}
+		}
+		if best >= 0 {
+			g.ID = candidates[best].ID
+			candidates = append(candidates[:best], candidates[best+1:]...)
+		} else {
+			p.nextID++
+			g.ID = p.nextID
+		}
+	}
+}
+
+// symbolize returns the frames for the given stack, omitting runtime.goexit.
+func symbolize(pcs []uintptr) []*gostackparse.Frame {
+	var stack []*gostackparse.Frame
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if f.Function != "runtime.goexit" && f.Function != "" {
+			stack = append(stack, &gostackparse.Frame{Func: f.Function, File: f.File, Line: f.Line})
+		}
+		if !more {
+			return stack
+		}
+	}
+}
+
+// stackKey returns a map key for the given program counters.
+func stackKey(pcs []uintptr) string {
+	key := make([]byte, len(pcs)*8)
+	for i, pc := range pcs {
+		binary.LittleEndian.PutUint64(key[i*8:], uint64(pc))
+	}
+	return string(key)
+}
+
+// stackFuncKey returns a map key for the function names of the given stack.
+func stackFuncKey(stack []*gostackparse.Frame) string {
+	var key []byte
+	for _, f := range stack {
+		key = append(key, f.Func...)
+		key = append(key, 0)
+	}
+	return string(key)
+}
+
+// commonRootDepth returns the number of identical functions of a and b
+// starting from the root frame.
+func commonRootDepth(a, b []*gostackparse.Frame) int {
+	depth := 0
+	for i, j := len(a)-1, len(b)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if a[i].Func != b[j].Func {
+			break
+		}
+		depth++
+	}
+	return depth
+}
@@ -0,0 +1,216 @@
+package fgtrace
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DataDog/gostackparse"
+	"github.com/felixge/fgtrace/internal"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func TestProfilers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	profilers := map[string]func() Profiler{
+		"StackProfiler":  NewStackProfiler,
+		"RecordProfiler": NewRecordProfiler,
+	}
+	for name, newProfiler := range profilers {
+		t.Run(name, func(t *testing.T) {
+			t.Run("Goroutines", func(t *testing.T) {
+				stop := make(chan struct{})
+				defer close(stop)
+				go blockedHelper(stop)
+				time.Sleep(10 * time.Millisecond)
+
+				prof := newProfiler()
+				findHelper := func() *Goroutine {
+					gs, err := prof.Goroutines()
+					require.NoError(t, err)
+					for _, g := range gs {
+						for _, f := range g.Stack {
+							if strings.HasSuffix(f.Func, "fgtrace.blockedHelper") {
+								require.NotEmpty(t, f.File)
+								require.NotZero(t, f.Line)
+								return g
+							}
+						}
+					}
+					return nil
+				}
+				first := findHelper()
+				require.NotNil(t, first)
+				second := findHelper()
+				require.NotNil(t, second)
+				require.NotZero(t, first.ID)
+				require.Equal(t, first.ID, second.ID)
+			})
+
+			t.Run("Trace", func(t *testing.T) {
+				buf := &bytes.Buffer{}
+				conf := Config{Dst: Writer(buf), IncludeSelf: true, Profiler: newProfiler()}.WithDefaults()
+				trace := conf.Trace()
+				workloadSimulator(conf.Hz, time.Second/10)
+				require.NoError(t, trace.Stop())
+				data, err := internal.Unmarshal(buf.Bytes())
+				require.NoError(t, err)
+				calls := data.Filter(func(e *internal.Event) bool {
+					return e.Ph == "B" && strings.HasSuffix(e.Name, "fgtrace.workloadA")
+				})
+				require.Greater(t, calls.Len(), 0)
+				for _, e := range calls.Events {
+					// Only NewRecordProfiler() guesses the goroutine ids.
+					require.Equal(t, name == "RecordProfiler", e.Args["approximate_id"] == true)
+				}
+			})
+		})
+	}
+}
+
+func TestStackProfiler_labels(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	started, stop := make(chan struct{}), make(chan struct{})
+	defer close(stop)
+	go pprof.Do(context.Background(), pprof.Labels("endpoint", "/users/{id}", "user", "felix"), func(context.Context) {
+		close(started)
+		blockedHelper(stop)
+	})
+	<-started
+	enableTracebackLabels(t)
+
+	gs, err := NewStackProfiler().Goroutines()
+	require.NoError(t, err)
+	var helper *Goroutine
+	for _, g := range gs {
+		for _, f := range g.Stack {
+			if strings.HasSuffix(f.Func, "fgtrace.blockedHelper") {
+				helper = g
+			}
+		}
+	}
+	require.NotNil(t, helper)
+	require.Equal(t, map[string]string{"endpoint": "/users/{id}", "user": "felix"}, helper.Labels)
+}
+
+// enableTracebackLabels makes runtime.Stack() report pprof labels for the
+// duration of the test, or skips the test if the Go version doesn't support
+// it. It must be called while a goroutine with labels exists.
+func enableTracebackLabels(t *testing.T) {
+	// The default depends on the go version of the main module.
+	t.Setenv("GODEBUG", "tracebacklabels=1")
+	buf := make([]byte, 1024*1024)
+	if !bytes.Contains(buf[:runtime.Stack(buf, true)], labelsStart) {
+		t.Skip("runtime.Stack() doesn't report pprof labels")
+	}
+}
+
+// requireCreatorIDs skips the test if runtime.Stack() doesn't report the ids
+// of the goroutines that created the goroutines, see hasCreatorIDs().
+func requireCreatorIDs(t *testing.T) {
+	if !hasCreatorIDs() {
+		t.Skip("runtime.Stack() doesn't report creator goroutine ids")
+	}
+}
+
+// hasCreatorIDs returns true if runtime.Stack() reports the ids of the
+// goroutines that created the goroutines, which requires Go 1.21.
+func hasCreatorIDs() bool {
+	buf := make([]byte, 1024*1024)
+	return bytes.Contains(buf[:runtime.Stack(buf, true)], []byte(createdByIDPrefix))
+}
+
+func Test_stripLabels(t *testing.T) {
+	stack := strings.Join([]string{
+		`goroutine 1 [running]:`,
+		`main.main()`,
+		`	/app/main.go:8 +0x1ae`,
+		``,
+		`goroutine 7 [sleep, locked to thread] {endpoint: "/x}, y: \"z\"", request_id: abc_1, empty: }:`,
+		`time.Sleep(0x1bf08eb000)`,
+		`	/usr/local/go/src/runtime/time.go:368 +0x165`,
+		``,
+		`goroutine 8 [select] {broken}:`,
+		`main.worker()`,
+		``,
+	}, "\n")
+	got, labels := stripLabels([]byte(stack))
+	require.Equal(t, strings.Join([]string{
+		`goroutine 1 [running]:`,
+		`main.main()`,
+		`	/app/main.go:8 +0x1ae`,
+		``,
+		`goroutine 7 [sleep, locked to thread]:`,
+		`time.Sleep(0x1bf08eb000)`,
+		`	/usr/local/go/src/runtime/time.go:368 +0x165`,
+		``,
+		`goroutine 8 [select] {broken}:`,
+		`main.worker()`,
+		``,
+	}, "\n"), string(got))
+	require.Equal(t, map[int]map[string]string{
+		7: {"endpoint": `/x}, y: "z"`, "request_id": "abc_1", "empty": ""},
+	}, labels)
+
+	unlabeled := []byte("goroutine 1 [running]:\nmain.main()\n")
+	got, labels = stripLabels(unlabeled)
+	require.Equal(t, unlabeled, got)
+	require.Nil(t, labels)
+}
+
+func Test_stripCreatedByID(t *testing.T) {
+	f := &gostackparse.Frame{Func: "main.main in goroutine 1"}
+	require.Equal(t, 1, stripCreatedByID(f))
+	require.Equal(t, "main.main", f.Func)
+
+	f = &gostackparse.Frame{Func: "main.main"}
+	require.Equal(t, 0, stripCreatedByID(f))
+	require.Equal(t, "main.main", f.Func)
+
+	require.Equal(t, 0, stripCreatedByID(nil))
+}
+
+func TestRecordProfiler_assignIDs(t *testing.T) {
+	stack := func(funcs ...string) []*gostackparse.Frame {
+		frames := make([]*gostackparse.Frame, len(funcs))
+		for i, fn := range funcs {
+			frames[i] = &gostackparse.Frame{Func: fn}
+		}
+		return frames
+	}
+	goroutine := func(funcs ...string) *Goroutine {
+		return &Goroutine{Goroutine: gostackparse.Goroutine{Stack: stack(funcs...)}}
+	}
+
+	p := &recordProfiler{
+		nextID: 3,
+		prev: []recordGoroutine{
+			{ID: 1, Stack: stack("a", "main")},
+			{ID: 2, Stack: stack("b", "worker")},
+			{ID: 3, Stack: stack("b", "worker")},
+		},
+	}
+	gs := []*Goroutine{
+		goroutine("c", "worker"),
+		goroutine("a", "main"),
+		goroutine("b", "worker"),
+		goroutine("d", "other"),
+	}
+	p.assignIDs(gs)
+	var ids []int
+	for _, g := range gs {
+		ids = append(ids, g.ID)
+	}
+	require.Equal(t, []int{3, 1, 2, 4}, ids)
+}
+
+func blockedHelper(stop chan struct{}) {
+	<-stop
+}
@@ -0,0 +1,137 @@
+// Package reader implements streaming access to traces written by fgtrace in
+// the JSON format. Traces in the Perfetto format are not supported.
+//
+// A Reader decodes one event at a time, and a SpanReader reconstructs the
+// function calls of each goroutine from them, so even very large traces can
+// be processed without loading them into memory.
+package reader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/felixge/fgtrace/internal"
+)
+
+// Event is a single event of a trace in Chrome's Trace Event Format. For
+// events describing goroutines, Pid holds the goroutine id.
+type Event = internal.Event
+
+// NewReader returns a Reader that decodes the trace from r. The Reader does
+// its own buffering.
+func NewReader(r io.Reader) *Reader {
+	er := &eofReader{r: r}
+	return &Reader{
+		dec:   json.NewDecoder(er),
+		eof:   er,
+		names: map[int64]string{},
+	}
+}
+
+// Reader decodes the events of a trace one at a time.
+type Reader struct {
+	dec     *json.Decoder
+	eof     *eofReader
+	started bool
+	err     error
+	hz      int
+	states  string
+	names   map[int64]string
+}
+
+// Next returns the next event of the trace, or io.EOF after the last one.
+// Traces that are missing the closing bracket, e.g. because the process
+// writing them was killed, are read until the last complete event.
+func (r *Reader) Next() (*Event, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	ev, err := r.next()
+	if err != nil {
+		r.err = err
+		return nil, err
+	}
+
+	if ev.Ph == "M" {
+		switch ev.Name {
+		case "hz":
+			hz, _ := ev.Args["hz"].(float64)
+			r.hz = int(hz)
+		case "state_frames":
+			r.states, _ = ev.Args["state_frames"].(string)
+		case "process_name":
+			name, _ := ev.Args["name"].(string)
+			r.names[ev.Pid] = name
+		}
+	}
+	return ev, nil
+}
+
+func (r *Reader) next() (*Event, error) {
+	if !r.started {
+		r.started = true
+		if tok, err := r.dec.Token(); err != nil {
+			return nil, err
+		} else if tok != json.Delim('[') {
+			return nil, fmt.Errorf("reader: expected trace to start with '[', got %v", tok)
+		}
+	}
+
+	if !r.dec.More() {
+		if _, err := r.dec.Token(); err != nil {
+			return nil, r.truncated(err)
+		}
+		return nil, io.EOF
+	}
+	ev := &Event{}
+	if err := r.dec.Decode(ev); err != nil {
+		return nil, r.truncated(err)
+	}
+	return ev, nil
+}
+
+// truncated returns io.EOF if err was caused by the trace ending in the middle
+// of the JSON array.
+func (r *Reader) truncated(err error) error {
+	if r.started && r.eof.done {
+		return io.EOF
+	}
+	return err
+}
+
+// eofReader records if the underlying reader has been read until io.EOF.
+type eofReader struct {
+	r    io.Reader
+	done bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.done = true
+	}
+	return n, err
+}
+
+// Hz returns the sampling frequency of the trace, or 0 if it has not been
+// read yet. fgtrace writes it as the first event of every sampled trace, it
+// is missing from traces converted by exectrace.Convert().
+func (r *Reader) Hz() int {
+	return r.hz
+}
+
+// StateFrames returns the fgtrace.StateFrames setting of the trace ("root",
+// "leaf" or "no"), or "" if it has not been read yet or the trace was written
+// by an fgtrace version that didn't record it.
+func (r *Reader) StateFrames() string {
+	return r.states
+}
+
+// GoroutineName returns the name of the goroutine with the given id, e.g.
+// "G12 net/http.(*Server).Serve". The name is known once the first event of
+// the goroutine has been read.
+func (r *Reader) GoroutineName(id int64) (string, bool) {
+	name, ok := r.names[id]
+	return name, ok
+}
@@ -0,0 +1,204 @@
+package reader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/felixge/fgtrace"
+	"github.com/stretchr/testify/require"
+)
+
+const testTrace = `[{"name":"hz","ph":"M","ts":0,"args":{"hz":100}}
+,{"name":"state_frames","ph":"M","ts":0,"args":{"state_frames":"no"}}
+,{"name":"process_name","ph":"M","ts":0,"pid":1,"tid":1,"args":{"name":"G1"}}
+,{"name":"main","ph":"B","ts":0,"pid":1,"tid":1}
+,{"name":"a","ph":"B","ts":0,"pid":1,"tid":1}
+,{"name":"a","ph":"E","ts":10000,"pid":1,"tid":1}
+,{"name":"process_name","ph":"M","ts":0,"pid":2,"tid":1,"args":{"name":"G2 main.main"}}
+,{"name":"worker","ph":"B","ts":10000,"pid":2,"tid":1}
+,{"name":"b","ph":"B","ts":10000,"pid":1,"tid":1}
+,{"name":"worker","ph":"E","ts":20000,"pid":2,"tid":1}
+,{"name":"b","ph":"E","ts":30000,"pid":1,"tid":1}
+,{"name":"main","ph":"E","ts":30000,"pid":1,"tid":1}
+]`
+
+func TestReader(t *testing.T) {
+	t.Run("events", func(t *testing.T) {
+		r := NewReader(strings.NewReader(testTrace))
+		var names []string
+		for {
+			ev, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, ev.Ph+":"+ev.Name)
+		}
+		require.Equal(t, 12, len(names))
+		require.Equal(t, "M:hz", names[0])
+		require.Equal(t, 100, r.Hz())
+		require.Equal(t, "no", r.StateFrames())
+
+		name, ok := r.GoroutineName(2)
+		require.True(t, ok)
+		require.Equal(t, "G2 main.main", name)
+		_, ok = r.GoroutineName(3)
+		require.False(t, ok)
+
+		_, err := r.Next()
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		truncated := testTrace[:strings.Index(testTrace, `,{"name":"b","ph":"E"`)+10]
+		r := NewReader(strings.NewReader(truncated))
+		n := 0
+		for {
+			_, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			n++
+		}
+		require.Equal(t, 10, n)
+	})
+
+	t.Run("not-json", func(t *testing.T) {
+		_, err := NewReader(strings.NewReader(`{}`)).Next()
+		require.Error(t, err)
+	})
+}
+
+func TestSpanReader(t *testing.T) {
+	t.Run("complete", func(t *testing.T) {
+		sr := NewSpanReader(NewReader(strings.NewReader(testTrace)))
+		roots := readSpans(t, sr)
+		require.Equal(t, 2, len(roots))
+
+		require.Equal(t, "worker", roots[0].Func)
+		require.Equal(t, int64(2), roots[0].Pid)
+		require.Equal(t, 10*time.Millisecond, roots[0].Duration())
+
+		main := roots[1]
+		require.Equal(t, "main", main.Func)
+		require.Equal(t, 30*time.Millisecond, main.Duration())
+		require.Equal(t, 2, len(main.Children))
+		require.Equal(t, "a", main.Children[0].Func)
+		require.Equal(t, 10*time.Millisecond, main.Children[0].Duration())
+		require.Equal(t, "b", main.Children[1].Func)
+		require.Equal(t, 20*time.Millisecond, main.Children[1].Duration())
+		require.Equal(t, main, main.Children[1].Parent)
+		require.Equal(t, 1, main.Children[1].Depth())
+
+		var walked []string
+		main.Walk(func(s *Span) { walked = append(walked, s.Func) })
+		require.Equal(t, []string{"main", "a", "b"}, walked)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		truncated := testTrace[:strings.Index(testTrace, `,{"name":"worker","ph":"E"`)]
+		sr := NewSpanReader(NewReader(strings.NewReader(truncated)))
+		roots := readSpans(t, sr)
+		require.Equal(t, 2, len(roots))
+		require.Equal(t, "main", roots[0].Func)
+		require.Equal(t, float64(10000), roots[0].End)
+		require.Equal(t, "worker", roots[1].Func)
+		require.Equal(t, float64(10000), roots[1].End)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		trace := `[{"name":"a","ph":"B","pid":1,"tid":1},{"name":"b","ph":"E","pid":1,"tid":1}]`
+		_, err := NewSpanReader(NewReader(strings.NewReader(trace))).Next()
+		require.Error(t, err)
+	})
+
+	t.Run("large", func(t *testing.T) {
+		// Stream a trace with many goroutines through a pipe to make sure it is
+		// processed incrementally rather than being buffered.
+		const goroutines = 10000
+		pr, pw := io.Pipe()
+		go func() {
+			fmt.Fprint(pw, `[{"name":"hz","ph":"M","ts":0,"args":{"hz":99}}`)
+			for i := 1; i <= goroutines; i++ {
+				fmt.Fprintf(pw, `,{"name":"f","ph":"B","ts":%d,"pid":%d,"tid":1}`, i, i)
+				fmt.Fprintf(pw, `,{"name":"f","ph":"E","ts":%d,"pid":%d,"tid":1}`, i+1, i)
+			}
+			fmt.Fprint(pw, `]`)
+			pw.Close()
+		}()
+
+		sr := NewSpanReader(NewReader(pr))
+		n := 0
+		for {
+			span, err := sr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			n++
+			require.Equal(t, int64(n), span.Pid)
+			require.Equal(t, 0, len(sr.stacks))
+		}
+		require.Equal(t, goroutines, n)
+	})
+
+	t.Run("fgtrace", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		trace := fgtrace.Config{Dst: fgtrace.Writer(buf), IncludeSelf: true}.Trace()
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, trace.Stop())
+
+		r := NewReader(buf)
+		roots := readSpans(t, NewSpanReader(r))
+		require.Greater(t, len(roots), 0)
+		require.Equal(t, 99, r.Hz())
+		require.Equal(t, "root", r.StateFrames())
+		for _, root := range roots {
+			name, ok := r.GoroutineName(root.Pid)
+			require.True(t, ok)
+			require.True(t, strings.HasPrefix(name, fmt.Sprintf("G%d", root.Pid)))
+		}
+	})
+}
+
+func readSpans(t *testing.T, sr *SpanReader) []*Span {
+	var spans []*Span
+	for {
+		span, err := sr.Next()
+		if err == io.EOF {
+			return spans
+		}
+		require.NoError(t, err)
+		spans = append(spans, span)
+	}
+}
+
+func ExampleSpanReader() {
+	r := NewReader(strings.NewReader(testTrace))
+	sr := NewSpanReader(r)
+	for {
+		root, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			panic(err)
+		}
+		name, _ := r.GoroutineName(root.Pid)
+		fmt.Printf("%s:\n", name)
+		root.Walk(func(s *Span) {
+			fmt.Printf("%s%s %s\n", strings.Repeat("  ", s.Depth()), s.Func, s.Duration())
+		})
+	}
+	// Output:
+	// G2 main.main:
+	// worker 10ms
+	// G1:
+	// main 30ms
+	//   a 10ms
+	//   b 20ms
+}
@@ -0,0 +1,149 @@
+package reader
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Span is a function call reconstructed from the begin and end events of a
+// goroutine. Start and End are timestamps in microseconds, like the Ts of
+// events.
+type Span struct {
+	Pid      int64 // goroutine id
+	Tid      int64
+	Func     string
+	Start    float64
+	End      float64
+	Args     map[string]interface{} // args of the begin event, e.g. file and line
+	Parent   *Span
+	Children []*Span // in the order they were called
+}
+
+// Duration returns the wall clock time between the start and end of s.
+func (s *Span) Duration() time.Duration {
+	return time.Duration((s.End - s.Start) * float64(time.Microsecond))
+}
+
+// Depth returns the number of ancestors of s.
+func (s *Span) Depth() int {
+	depth := 0
+	for p := s.Parent; p != nil; p = p.Parent {
+		depth++
+	}
+	return depth
+}
+
+// Walk calls fn for s and all of its descendants in depth-first order.
+func (s *Span) Walk(fn func(*Span)) {
+	fn(s)
+	for _, c := range s.Children {
+		c.Walk(fn)
+	}
+}
+
+// NewSpanReader returns a SpanReader that reconstructs the spans from the
+// events of r.
+func NewSpanReader(r *Reader) *SpanReader {
+	return &SpanReader{r: r, stacks: map[track][]*Span{}}
+}
+
+// SpanReader reconstructs the span trees of all goroutines of a trace. Only
+// the trees that are currently open are held in memory.
+type SpanReader struct {
+	r      *Reader
+	stacks map[track][]*Span // open spans of each track, root first
+	lastTs float64
+	eof    bool
+	closed []*Span // roots of trees closed at EOF that are yet to be returned
+}
+
+// track identifies the events belonging to the same stack.
+type track struct {
+	pid, tid int64
+}
+
+// Next returns the root span of the next complete span tree, in the order in
+// which the roots end, or io.EOF after the last one. Spans that are still open
+// at the end of a truncated trace are ended at the last timestamp of the
+// trace.
+func (s *SpanReader) Next() (*Span, error) {
+	for !s.eof {
+		ev, err := s.r.Next()
+		if err == io.EOF {
+			s.closeAll()
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch ev.Ph {
+		case "B", "E":
+			s.lastTs = ev.Ts
+		default:
+			continue
+		}
+
+		t := track{ev.Pid, ev.Tid}
+		stack := s.stacks[t]
+		if ev.Ph == "B" {
+			span := &Span{Pid: ev.Pid, Tid: ev.Tid, Func: ev.Name, Start: ev.Ts, Args: ev.Args}
+			if len(stack) > 0 {
+				span.Parent = stack[len(stack)-1]
+				span.Parent.Children = append(span.Parent.Children, span)
+			}
+			s.stacks[t] = append(stack, span)
+			continue
+		}
+
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("reader: end event without begin event: %q pid=%d tid=%d ts=%v", ev.Name, ev.Pid, ev.Tid, ev.Ts)
+		}
+		span := stack[len(stack)-1]
+		if span.Func != ev.Name {
+			return nil, fmt.Errorf("reader: end event %q does not match begin event %q: pid=%d tid=%d ts=%v", ev.Name, span.Func, ev.Pid, ev.Tid, ev.Ts)
+		}
+		span.End = ev.Ts
+		if len(stack) > 1 {
+			s.stacks[t] = stack[:len(stack)-1]
+			continue
+		}
+		delete(s.stacks, t)
+		return span, nil
+	}
+
+	if len(s.closed) == 0 {
+		return nil, io.EOF
+	}
+	span := s.closed[0]
+	s.closed = s.closed[1:]
+	return span, nil
+}
+
+// closeAll ends all open spans at the last timestamp of the trace and queues
+// their roots ordered by start time.
+func (s *SpanReader) closeAll() {
+	s.eof = true
+	for t, stack := range s.stacks {
+		for _, span := range stack {
+			span.End = s.lastTs
+		}
+		s.closed = append(s.closed, stack[0])
+		delete(s.stacks, t)
+	}
+	sortSpans(s.closed)
+}
+
+// sortSpans sorts spans by start time, pid and tid.
+func sortSpans(spans []*Span) {
+	sort.Slice(spans, func(i, j int) bool {
+		a, b := spans[i], spans[j]
+		if a.Start != b.Start {
+			return a.Start < b.Start
+		} else if a.Pid != b.Pid {
+			return a.Pid < b.Pid
+		}
+		return a.Tid < b.Tid
+	})
+}
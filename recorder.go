@@ -0,0 +1,114 @@
+package fgtrace
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Snapshot writes the samples currently held by a trace in flight recorder
+// mode (see Config.Window) to w. The result is a self-contained trace in the
+// configured format that begins with the stacks that were active at the start
+// of the window. Snapshot can be called while the trace is being captured as
+// well as after it has been stopped.
+func (t *Trace) Snapshot(w io.Writer) error {
+	return t.snapshot(w, "")
+}
+
+// snapshot implements Snapshot. See encodeMeta() for trigger.
+func (t *Trace) snapshot(w io.Writer, trigger string) error {
+	if t.rec == nil {
+		return errors.New("snapshots require Config.Window or Config.WindowBytes")
+	}
+
+	enc, err := newEncoder(t.c, w)
+	if err != nil {
+		return err
+	} else if err := t.encodeMeta(enc, trigger); err != nil {
+		return err
+	} else if err := t.rec.encode(newTimeline(enc, t.c.Hz), t.ts(t.clock.Now())); err != nil {
+		return err
+	}
+	return enc.Finish()
+}
+
+// recorder keeps the samples of the most recent window of a trace in memory.
+type recorder struct {
+	window   time.Duration // max time between the oldest and newest sample
+	maxBytes int           // max value for bytes
+
+	mu      sync.Mutex
+	samples []*sample // samples in the window, oldest first
+	sizes   []int     // sampleSize() of samples
+	bytes   int       // sum of sizes
+	stopTs  float64   // ts at which the trace was stopped, 0 while running
+}
+
+// add appends s and evicts the oldest samples that no longer fit into the
+// window. The newest sample is always kept.
+func (r *recorder) add(s *sample) {
+	size := sampleSize(s)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.samples = append(r.samples, s)
+	r.sizes = append(r.sizes, size)
+	r.bytes += size
+	for len(r.samples) > 1 {
+		tooOld := r.window > 0 && s.ts-r.samples[0].ts > float64(r.window.Microseconds())
+		tooBig := r.maxBytes > 0 && r.bytes > r.maxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		r.bytes -= r.sizes[0]
+		r.samples[0] = nil
+		r.samples, r.sizes = r.samples[1:], r.sizes[1:]
+	}
+}
+
+// stop records the ts at which the trace was stopped. Snapshots taken after
+// that end at ts rather than the time they are taken.
+func (r *recorder) stop(ts float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopTs = ts
+}
+
+// encode adds the samples of the window to tl and ends it at ts, or the ts at
+// which the trace was stopped.
+func (r *recorder) encode(tl *timeline, ts float64) error {
+	r.mu.Lock()
+	samples := append([]*sample(nil), r.samples...)
+	if r.stopTs != 0 {
+		ts = r.stopTs
+	}
+	r.mu.Unlock()
+
+	for _, s := range samples {
+		if err := tl.add(s); err != nil {
+			return err
+		}
+	}
+	return tl.end(ts)
+}
+
+// sampleSize returns the approximate number of bytes of memory used by s.
+func sampleSize(s *sample) int {
+	const (
+		goroutineSize = 128 // Goroutine + map entry in timeline
+		frameSize     = 64  // gostackparse.Frame + pointer in Stack
+		counterSize   = 40  // counter
+		sliceSize     = 96  // runtimeSlice
+		userEventSize = 128 // userEvent + args
+	)
+	size := len(s.counters)*counterSize + len(s.slices)*sliceSize + len(s.annotations)*userEventSize
+	for _, g := range s.goroutines {
+		size += goroutineSize + len(g.State)
+		for _, f := range g.Stack {
+			size += frameSize + len(f.Func) + len(f.File)
+		}
+	}
+	return size
+}
@@ -0,0 +1,82 @@
+package fgtrace
+
+// newGoroutineTree returns a goroutineTree rooted at the goroutine with the
+// given id.
+func newGoroutineTree(root int) *goroutineTree {
+	return &goroutineTree{
+		members: map[int]bool{root: true},
+		seen:    map[int]bool{},
+		ready:   make(chan struct{}),
+	}
+}
+
+// goroutineTree tracks a goroutine and its descendants across samples.
+// Goroutines join the tree when they are first observed after the first
+// sample and their creator, as reported in the "created by ... in goroutine
+// N" line of their stack trace, is a member. Goroutines that are observed
+// outside of the tree never join it, and members stay in the tree after their
+// creator exits. The runtime doesn't reuse goroutine ids, so goroutines are
+// forgotten once they exit. Only the direct creator of a goroutine is known,
+// so goroutines whose creator was never observed, e.g. because it started and
+// exited between two samples, can't join the tree.
+type goroutineTree struct {
+	members map[int]bool  // members observed by the last sample
+	exited  map[int]bool  // members that exited before the last sample
+	seen    map[int]bool  // goroutines observed by the last sample that are not members
+	started bool          // true after the first sample
+	ready   chan struct{} // closed after the first sample
+}
+
+// filter adds the new descendants in gs to the tree and returns the members
+// of gs.
+func (t *goroutineTree) filter(gs []*Goroutine) []*Goroutine {
+	// Children may be listed before their creator, so this repeats until
+	// no more goroutines join the tree. The creator may have exited since
+	// the last sample.
+	for joined := t.started; joined; {
+		joined = false
+		for _, g := range gs {
+			if t.members[g.ID] || t.seen[g.ID] || !t.members[g.CreatedByID] {
+				continue
+			}
+			t.members[g.ID] = true
+			joined = true
+		}
+	}
+
+	newGS := make([]*Goroutine, 0, len(gs))
+	members := make(map[int]bool, len(t.members))
+	seen := make(map[int]bool, len(t.seen))
+	for _, g := range gs {
+		if t.members[g.ID] {
+			newGS = append(newGS, g)
+			members[g.ID] = true
+		} else {
+			seen[g.ID] = true
+		}
+	}
+	t.exited = make(map[int]bool)
+	for id := range t.members {
+		if !members[id] {
+			t.exited[id] = true
+		}
+	}
+	t.members, t.seen = members, seen
+	if !t.started {
+		t.started = true
+		close(t.ready)
+	}
+	return newGS
+}
+
+// annotations returns the events of events that belong to members, including
+// the ones that exited since the previous sample.
+func (t *goroutineTree) annotations(events []userEvent) []userEvent {
+	newEvents := events[:0]
+	for _, ev := range events {
+		if t.members[ev.G] || t.exited[ev.G] {
+			newEvents = append(newEvents, ev)
+		}
+	}
+	return newEvents
+}
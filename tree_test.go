@@ -0,0 +1,47 @@
+package fgtrace
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_goroutineTree(t *testing.T) {
+	child := func(id, createdBy int) *Goroutine {
+		g := newTestGoroutine(id, "running", "main")
+		g.CreatedByID = createdBy
+		return g
+	}
+	ids := func(gs []*Goroutine) []int {
+		var ids []int
+		for _, g := range gs {
+			ids = append(ids, g.ID)
+		}
+		return ids
+	}
+
+	tree := newGoroutineTree(2)
+	// 3 exists before the trace starts, so it's not part of the tree.
+	require.Equal(t, []int{2}, ids(tree.filter([]*Goroutine{child(1, 0), child(2, 1), child(3, 2)})))
+	// 5 is listed before its creator 4.
+	require.Equal(t, []int{2, 5, 4}, ids(tree.filter([]*Goroutine{child(1, 0), child(2, 1), child(3, 2), child(5, 4), child(4, 2), child(6, 1)})))
+	// 5 remains after its creator exited, 7 was created by 3, which is not part of the tree.
+	require.Equal(t, []int{5, 8}, ids(tree.filter([]*Goroutine{child(3, 2), child(5, 4), child(6, 1), child(7, 3), child(8, 5)})))
+
+	// 2 and 4 exited since the previous sample, so their events are kept.
+	events := tree.annotations([]userEvent{{G: 1}, {G: 2}, {G: 3}, {G: 4}, {G: 8}})
+	require.Equal(t, []userEvent{{G: 2}, {G: 4}, {G: 8}}, events)
+
+	// Exited goroutines are forgotten after the next sample.
+	require.Equal(t, []int{8}, ids(tree.filter([]*Goroutine{child(8, 5)})))
+	require.Equal(t, map[int]bool{8: true}, tree.members)
+	require.Equal(t, map[int]bool{5: true}, tree.exited)
+	require.Empty(t, tree.seen)
+	events = tree.annotations([]userEvent{{G: 2}, {G: 5}, {G: 8}})
+	require.Equal(t, []userEvent{{G: 5}, {G: 8}}, events)
+
+	// 9 was created by 8 and exited before the next sample after creating 10,
+	// so 10 and its descendants can't be linked to the tree.
+	require.Equal(t, []int{8}, ids(tree.filter([]*Goroutine{child(8, 5), child(10, 9)})))
+	require.Equal(t, []int{8}, ids(tree.filter([]*Goroutine{child(8, 5), child(10, 9), child(11, 10)})))
+}
@@ -0,0 +1,428 @@
+package fgtrace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/felixge/fgtrace/internal"
+)
+
+const (
+	defaultTriggerInterval   = time.Second
+	defaultTriggerDuration   = 10 * time.Second
+	defaultTriggerCooldown   = time.Minute
+	defaultTriggerMaxPerHour = 10
+)
+
+// TriggerConfig configures a Watcher that captures traces automatically when
+// one of its Conditions fires, the process receives one of its Signals or
+// Trigger() is called. The zero value is a valid configuration that only
+// reacts to Trigger().
+type TriggerConfig struct {
+	// Config configures the captured traces. Its Dst and CallerTree are
+	// ignored, the Dst of the TriggerConfig is used instead, and
+	// ExecutionTrace is only used in flight recorder mode. If it enables
+	// flight recorder mode (see Config.Window), the Watcher traces
+	// continuously and each capture is a Trace.Snapshot() of the window
+	// leading up to the trigger. Otherwise a new trace of length Duration is
+	// started by every trigger.
+	Config Config
+	// Conditions are checked every Interval and start a capture when one of
+	// them returns a reason.
+	Conditions []Condition
+	// Signals start a capture when the process receives one of them, e.g.
+	// syscall.SIGUSR1. The name of the signal is used as the reason.
+	Signals []os.Signal
+	// Interval is the time between two checks of the Conditions. A check only
+	// captures the goroutines using Config.Profiler if one of the Conditions
+	// needs them, see Check. WithDefaults() sets it to 1s if it is 0.
+	Interval time.Duration
+	// Duration is the length of each capture outside of flight recorder mode.
+	// WithDefaults() sets it to 10s if it is 0.
+	Duration time.Duration
+	// Cooldown is the min time between the end of a capture and the start of
+	// the next one. Triggers that fire while a capture is running or during
+	// the cooldown are ignored. WithDefaults() sets it to 1m if it is 0, a
+	// negative value disables it.
+	Cooldown time.Duration
+	// MaxPerHour limits the number of captures started within any hour.
+	// WithDefaults() sets it to 10 if it is 0, a negative value disables it.
+	MaxPerHour int
+	// Dst returns the destination for the capture started at the given time
+	// for the given reason. WithDefaults() sets it to a func that creates
+	// files named after the time of the capture in the current directory, e.g.
+	// "fgtrace-20220601T150405.000.json", if it is nil.
+	Dst func(at time.Time, reason string) io.WriteCloser
+	// Logf is called with a message after every capture, e.g. log.Printf. The
+	// message includes the Dst of the capture, which is the file name for
+	// destinations created by File() or GzipFile(). No messages are logged if
+	// it is nil.
+	Logf func(format string, args ...interface{})
+
+	// clock is the source of time for the watcher and its traces,
+	// internal.RealClock{} if nil.
+	clock internal.Clock
+}
+
+// Condition decides if a Watcher should start a capture. It is called from a
+// single goroutine with the time of the check and returns a non-empty reason
+// to start a capture. The check only captures the goroutines if a Condition
+// asks for them, see Check.
+type Condition func(now time.Time, check *Check) string
+
+// Check provides the state of the process to the Conditions of a single check
+// of a Watcher.
+type Check struct {
+	profiler    Profiler
+	includeSelf bool
+	goroutines  []*Goroutine
+	captured    bool  // goroutines have been captured
+	err         error // error of capturing the goroutines
+}
+
+// NumGoroutine returns the number of goroutines including the ones of
+// fgtrace, see runtime.NumGoroutine(). Unlike Goroutines() it doesn't stop the
+// world.
+func (c *Check) NumGoroutine() int {
+	return runtime.NumGoroutine()
+}
+
+// Goroutines returns the goroutines captured by the Config.Profiler of the
+// TriggerConfig. They are captured by the first call and shared by all
+// Conditions of the check, which stops the world for NewStackProfiler(), so
+// Conditions should only call it when they need more than NumGoroutine().
+// Goroutines of fgtrace are excluded unless Config.IncludeSelf is set. If
+// capturing them fails, it returns nil and the check reports the error.
+func (c *Check) Goroutines() []*Goroutine {
+	if c.captured {
+		return c.goroutines
+	}
+	c.captured = true
+	c.goroutines, c.err = c.profiler.Goroutines()
+	if c.err != nil {
+		c.goroutines = nil
+	} else if !c.includeSelf {
+		c.goroutines = excludeSelf(c.goroutines)
+	}
+	return c.goroutines
+}
+
+// GoroutinesAbove returns a Condition that fires when there are more than n
+// goroutines according to Check.NumGoroutine(), so it doesn't capture the
+// goroutines.
+func GoroutinesAbove(n int) Condition {
+	return func(_ time.Time, check *Check) string {
+		if num := check.NumGoroutine(); num > n {
+			return fmt.Sprintf("%d goroutines", num)
+		}
+		return ""
+	}
+}
+
+// FuncRunningFor returns a Condition that fires when a goroutine has had a
+// stack frame with a function matching fn on its stack for at least d, as
+// observed by consecutive checks. It captures the goroutines at every check,
+// see Check.Goroutines().
+func FuncRunningFor(fn *regexp.Regexp, d time.Duration) Condition {
+	since := map[int]time.Time{} // goroutine id -> first check with a match
+	return func(now time.Time, check *Check) string {
+		goroutines := check.Goroutines()
+		current := make(map[int]time.Time, len(since))
+		reason := ""
+		for _, g := range goroutines {
+			for _, f := range g.Stack {
+				if !fn.MatchString(f.Func) {
+					continue
+				}
+				start, ok := since[g.ID]
+				if !ok {
+					start = now
+				}
+				current[g.ID] = start
+				if reason == "" && now.Sub(start) >= d {
+					reason = fmt.Sprintf("G%d running %s for %s", g.ID, f.Func, now.Sub(start))
+				}
+				break
+			}
+		}
+		since = current
+		return reason
+	}
+}
+
+// NotifySignal applies WithDefaults to c and returns a Watcher that captures a
+// trace of c.HTTPDuration to a file named after the time of the capture, e.g.
+// "fgtrace-20220601T150405.000.json", whenever the process receives one of the
+// given signals. Signals received while a capture is running are ignored. The
+// name of each file is logged using log.Printf(). Callers are responsible for
+// calling Watcher.Stop(), which stops the delivery of the signals.
+func (c Config) NotifySignal(sig ...os.Signal) *Watcher {
+	c = c.WithDefaults()
+	return TriggerConfig{
+		Config:     c,
+		Signals:    sig,
+		Duration:   c.HTTPDuration,
+		Cooldown:   -1,
+		MaxPerHour: -1,
+		Logf:       log.Printf,
+		clock:      c.clock,
+	}.Watch()
+}
+
+// WithDefaults returns a copy of c with default values applied as described
+// in the type documentation. This is done automatically by Watch().
+func (c TriggerConfig) WithDefaults() TriggerConfig {
+	c.Config = c.Config.WithDefaults()
+	if c.Interval == 0 {
+		c.Interval = defaultTriggerInterval
+	}
+	if c.Duration == 0 {
+		c.Duration = defaultTriggerDuration
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = defaultTriggerCooldown
+	}
+	if c.MaxPerHour == 0 {
+		c.MaxPerHour = defaultTriggerMaxPerHour
+	}
+	if c.Dst == nil {
+		ext := ".json"
+		switch c.Config.Format {
+		case FormatPerfetto:
+			ext = ".pftrace"
+		case FormatPprof:
+			ext = ".pprof"
+		}
+		c.Dst = func(at time.Time, _ string) io.WriteCloser {
+			return File("fgtrace-" + at.Format(internal.FileTimeFormat) + ext)
+		}
+	}
+	return c
+}
+
+// Watch applies WithDefaults to c and starts watching for triggers. Callers
+// are responsible for calling Watcher.Stop().
+func (c TriggerConfig) Watch() *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		c:        c.WithDefaults(),
+		clock:    c.clock,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		triggers: make(chan string, 1),
+		captured: make(chan error, 1),
+	}
+	if w.clock == nil {
+		w.clock = internal.RealClock{}
+	}
+	w.c.Config.clock = w.clock
+	w.c.Config.CallerTree = false
+	if w.c.Config.Window != 0 || w.c.Config.WindowBytes != 0 {
+		conf := w.c.Config
+		conf.Dst = Writer(io.Discard)
+		w.recording = conf.Trace()
+	}
+	// Captures outside of flight recorder mode are separate traces that can't
+	// share the source.
+	w.c.Config.ExecutionTrace = nil
+	tick := w.clock.NewTicker(w.c.Interval)
+	var signals chan os.Signal // nil unless Signals are given, blocks forever
+	if len(w.c.Signals) > 0 {
+		signals = make(chan os.Signal, 1)
+		signal.Notify(signals, w.c.Signals...)
+	}
+	watchers.add(w)
+	go func() {
+		defer close(w.done)
+		w.err = w.watch(ctx, tick, signals)
+	}()
+	return w
+}
+
+// Trigger starts a capture with the given reason by all Watchers, unless they
+// are already capturing, in their cooldown or have reached their
+// MaxPerHour. It can be called by applications that notice a problem, e.g. a
+// slow request, to capture what happens next, or in flight recorder mode,
+// what led up to it.
+func Trigger(reason string) {
+	watchers.mu.Lock()
+	defer watchers.mu.Unlock()
+	for w := range watchers.m {
+		select {
+		case w.triggers <- reason:
+		default:
+			// A trigger is already pending.
+		}
+	}
+}
+
+// watchers holds the Watchers that receive calls to Trigger().
+var watchers = &watcherSet{m: map[*Watcher]struct{}{}}
+
+type watcherSet struct {
+	mu sync.Mutex
+	m  map[*Watcher]struct{}
+}
+
+func (s *watcherSet) add(w *Watcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[w] = struct{}{}
+}
+
+func (s *watcherSet) remove(w *Watcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, w)
+}
+
+// Watcher captures traces when the triggers of its TriggerConfig fire.
+type Watcher struct {
+	c         TriggerConfig
+	clock     internal.Clock
+	cancel    context.CancelFunc
+	done      chan struct{} // closed once the watcher is stopped and err is set
+	err       error         // first error encountered by the watcher
+	triggers  chan string   // reasons passed to Trigger()
+	captured  chan error    // receives the result of each capture
+	recording *Trace        // continuous trace in flight recorder mode
+
+	capturing bool        // true while a capture is running
+	lastEnd   time.Time   // end of the last capture
+	starts    []time.Time // start of the captures within the last hour
+}
+
+// Stop stops watching, waits for a running capture to finish and stops the
+// trace used in flight recorder mode. It returns the first error encountered
+// by any of the captures.
+func (w *Watcher) Stop() error {
+	watchers.remove(w)
+	w.cancel()
+	<-w.done
+	return w.err
+}
+
+// watch checks the triggers until ctx is done.
+func (w *Watcher) watch(ctx context.Context, tick internal.Ticker, signals chan os.Signal) error {
+	defer tick.Stop()
+	if signals != nil {
+		defer signal.Stop(signals)
+	}
+
+	var err error
+	setErr := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	for {
+		select {
+		case now := <-tick.C():
+			if reason, e := w.check(now); e != nil {
+				setErr(e)
+			} else if reason != "" {
+				setErr(w.capture(ctx, now, reason))
+			}
+		case reason := <-w.triggers:
+			setErr(w.capture(ctx, w.clock.Now(), reason))
+		case sig := <-signals:
+			setErr(w.capture(ctx, w.clock.Now(), sig.String()))
+		case e := <-w.captured:
+			setErr(e)
+			w.capturing = false
+			w.lastEnd = w.clock.Now()
+		case <-ctx.Done():
+			if w.capturing {
+				setErr(<-w.captured)
+			}
+			if w.recording != nil {
+				setErr(w.recording.Stop())
+			}
+			return err
+		}
+	}
+}
+
+// check returns the reason of the first Condition that fires at now.
+func (w *Watcher) check(now time.Time) (string, error) {
+	if len(w.c.Conditions) == 0 || w.capturing {
+		return "", nil
+	}
+	check := &Check{profiler: w.c.Config.Profiler, includeSelf: w.c.Config.IncludeSelf}
+	for _, cond := range w.c.Conditions {
+		reason := cond(now, check)
+		if check.err != nil {
+			return "", check.err
+		} else if reason != "" {
+			return reason, nil
+		}
+	}
+	return "", nil
+}
+
+// capture starts a capture for reason at now unless a capture is running or
+// the cooldown or MaxPerHour prevent it.
+func (w *Watcher) capture(ctx context.Context, now time.Time, reason string) error {
+	if w.capturing {
+		return nil
+	} else if w.c.Cooldown > 0 && !w.lastEnd.IsZero() && now.Sub(w.lastEnd) < w.c.Cooldown {
+		return nil
+	}
+	for len(w.starts) > 0 && now.Sub(w.starts[0]) >= time.Hour {
+		w.starts = w.starts[1:]
+	}
+	if w.c.MaxPerHour > 0 && len(w.starts) >= w.c.MaxPerHour {
+		return nil
+	}
+	w.starts = append(w.starts, now)
+
+	dst := w.c.Dst(now, reason)
+	if w.recording != nil {
+		err := w.recording.snapshot(dst, reason)
+		if closeErr := dst.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		w.logCapture(dst, reason, err)
+		w.lastEnd = now
+		return err
+	}
+
+	conf := w.c.Config
+	conf.Dst = dst
+	conf.trigger = reason
+	trace := conf.TraceContext(ctx)
+	// Create the ticker before returning, so tests can't advance the clock
+	// before the capture is ready for it.
+	end := w.clock.NewTicker(w.c.Duration)
+	w.capturing = true
+	go func() {
+		defer end.Stop()
+		select {
+		case <-end.C():
+		case <-ctx.Done():
+		}
+		err := trace.Stop()
+		w.logCapture(dst, reason, err)
+		w.captured <- err
+	}()
+	return nil
+}
+
+// logCapture reports the result of the capture for reason to dst via Logf.
+func (w *Watcher) logCapture(dst io.WriteCloser, reason string, err error) {
+	if w.c.Logf == nil {
+		return
+	} else if err != nil {
+		w.c.Logf("fgtrace: %s: failed to write trace to %v: %s", reason, dst, err)
+		return
+	}
+	w.c.Logf("fgtrace: %s: wrote trace to %v", reason, dst)
+}
@@ -0,0 +1,57 @@
+//go:build linux || darwin
+
+package fgtrace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcher_Signals(t *testing.T) {
+	t.Run("TriggerConfig", func(t *testing.T) {
+		dst := newTestCaptures()
+		var mu sync.Mutex
+		var logs []string
+		w := TriggerConfig{
+			Duration: time.Millisecond,
+			Signals:  []os.Signal{syscall.SIGUSR1},
+			Dst:      dst.Dst,
+			Logf: func(format string, args ...interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				logs = append(logs, fmt.Sprintf(format, args...))
+			},
+		}.Watch()
+		require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+		require.Equal(t, syscall.SIGUSR1.String(), <-dst.started)
+		require.NoError(t, w.Stop())
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, logs, 1)
+		require.Contains(t, logs[0], "fgtrace: "+syscall.SIGUSR1.String()+": wrote trace to ")
+	})
+
+	t.Run("NotifySignal", func(t *testing.T) {
+		wd, err := os.Getwd()
+		require.NoError(t, err)
+		dir := t.TempDir()
+		require.NoError(t, os.Chdir(dir))
+		defer os.Chdir(wd)
+
+		w := Config{HTTPDuration: 10 * time.Millisecond}.NotifySignal(syscall.SIGUSR1)
+		require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+		require.Eventually(t, func() bool {
+			names, _ := filepath.Glob(filepath.Join(dir, "fgtrace-*.json"))
+			return len(names) == 1
+		}, time.Second, time.Millisecond)
+		require.NoError(t, w.Stop())
+	})
+}
@@ -0,0 +1,187 @@
+package fgtrace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felixge/fgtrace/internal"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func ExampleTrigger() {
+	// Capture traces when there are more than 10k goroutines or a request
+	// handler reports that it's slow.
+	watcher := TriggerConfig{Conditions: []Condition{GoroutinesAbove(10000)}}.Watch()
+	defer watcher.Stop()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// <handle request>
+		if time.Since(start) > time.Second {
+			Trigger("slow request")
+		}
+	})
+}
+
+func TestWatcher(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	t.Run("Conditions", func(t *testing.T) {
+		clock := internal.NewFakeClock(time.Now())
+		dst := newTestCaptures()
+		w := TriggerConfig{
+			Config: Config{
+				Hz:          100,
+				StateFrames: StateFramesNo,
+				Profiler: &scriptedProfiler{Script: [][]*Goroutine{
+					{newTestGoroutine(1, "running", "main")},
+					{newTestGoroutine(1, "running", "main"), newTestGoroutine(2, "running", "worker")},
+				}},
+			},
+			Conditions: []Condition{FuncRunningFor(regexp.MustCompile(`^worker$`), 0)},
+			Dst:        dst.Dst,
+			clock:      clock,
+		}.Watch()
+		clock.Advance(time.Second)
+		clock.Advance(time.Second)
+		reason := <-dst.started
+		require.NoError(t, w.Stop())
+
+		require.Equal(t, "G2 running worker for 0s", reason)
+		data, err := internal.Unmarshal(dst.bufs[0].Bytes())
+		require.NoError(t, err)
+		require.Equal(t, []*internal.Event{
+			{Name: "trigger", Ph: "M", Args: map[string]interface{}{"trigger": "G2 running worker for 0s"}},
+		}, data.Filter(func(e *internal.Event) bool { return e.Name == "trigger" }).Events)
+		require.Greater(t, data.Filter(func(e *internal.Event) bool { return e.Name == "worker" }).Len(), 0)
+	})
+
+	t.Run("Trigger", func(t *testing.T) {
+		dst := newTestCaptures()
+		w := TriggerConfig{Duration: time.Millisecond, Dst: dst.Dst}.Watch()
+		Trigger("slow request")
+		require.Equal(t, "slow request", <-dst.started)
+		require.NoError(t, w.Stop())
+		Trigger("after stop")
+		require.Len(t, dst.bufs, 1)
+	})
+
+	t.Run("capture", func(t *testing.T) {
+		start := time.Now()
+		clock := internal.NewFakeClock(start)
+		dst := newTestCaptures()
+		recording := Config{
+			Dst:      Writer(io.Discard),
+			Window:   time.Second,
+			Profiler: &scriptedProfiler{Script: [][]*Goroutine{{newTestGoroutine(1, "running", "main")}}},
+			clock:    clock,
+		}.Trace()
+		defer recording.Stop()
+		w := &Watcher{
+			c:         TriggerConfig{MaxPerHour: 2, Dst: dst.Dst}.WithDefaults(),
+			clock:     clock,
+			recording: recording,
+		}
+
+		ctx := context.Background()
+		for _, c := range []struct {
+			At     time.Duration
+			Reason string
+		}{
+			{0, "a"},
+			{30 * time.Second, "cooldown"},
+			{2 * time.Minute, "b"},
+			{4 * time.Minute, "max per hour"},
+			{61 * time.Minute, "c"},
+		} {
+			require.NoError(t, w.capture(ctx, start.Add(c.At), c.Reason))
+		}
+		require.Equal(t, []string{"a", "b", "c"}, dst.reasons)
+		for _, buf := range dst.bufs {
+			data, err := internal.Unmarshal(buf.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, 1, data.Filter(func(e *internal.Event) bool { return e.Name == "trigger" }).Len())
+		}
+	})
+}
+
+func TestCheck(t *testing.T) {
+	t.Run("Goroutines", func(t *testing.T) {
+		p := &scriptedProfiler{Script: [][]*Goroutine{{newTestGoroutine(1, "running", "main")}}}
+		check := &Check{profiler: p, includeSelf: true}
+		require.Len(t, check.Goroutines(), 1)
+		require.Len(t, check.Goroutines(), 1)
+		require.Equal(t, 1, p.calls)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		check := &Check{profiler: errProfiler{}}
+		require.Nil(t, check.Goroutines())
+		require.EqualError(t, check.err, "whups")
+	})
+}
+
+func TestGoroutinesAbove(t *testing.T) {
+	p := &scriptedProfiler{Script: [][]*Goroutine{{}}}
+	check := &Check{profiler: p}
+	require.Regexp(t, `^\d+ goroutines$`, GoroutinesAbove(0)(time.Now(), check))
+	require.Equal(t, "", GoroutinesAbove(1<<30)(time.Now(), check))
+	// Counting goroutines doesn't capture them.
+	require.Equal(t, 0, p.calls)
+}
+
+func TestFuncRunningFor(t *testing.T) {
+	start := time.Now()
+	cond := FuncRunningFor(regexp.MustCompile(`^main\.slow$`), 2*time.Second)
+	slow := newTestGoroutine(7, "running", "main.slow", "main.main")
+	other := newTestGoroutine(8, "running", "main.main")
+
+	require.Equal(t, "", cond(start, newTestCheck(slow, other)))
+	require.Equal(t, "", cond(start.Add(time.Second), newTestCheck(slow, other)))
+	require.Equal(t, "G7 running main.slow for 2s", cond(start.Add(2*time.Second), newTestCheck(slow)))
+	// The goroutine has to be seen by consecutive checks.
+	require.Equal(t, "", cond(start.Add(3*time.Second), newTestCheck(other)))
+	require.Equal(t, "", cond(start.Add(4*time.Second), newTestCheck(slow)))
+}
+
+// newTestCheck returns a Check whose goroutines have been captured already.
+func newTestCheck(goroutines ...*Goroutine) *Check {
+	return &Check{goroutines: goroutines, captured: true}
+}
+
+// testCaptures is a TriggerConfig.Dst that writes to buffers.
+type testCaptures struct {
+	mu      sync.Mutex
+	bufs    []*bytes.Buffer
+	reasons []string
+	started chan string // receives the reason of each capture
+}
+
+func newTestCaptures() *testCaptures {
+	return &testCaptures{started: make(chan string, 10)}
+}
+
+func (c *testCaptures) Dst(_ time.Time, reason string) io.WriteCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := &bytes.Buffer{}
+	c.bufs = append(c.bufs, buf)
+	c.reasons = append(c.reasons, reason)
+	c.started <- reason
+	return Writer(buf)
+}
+
+// errProfiler is a Profiler that always fails.
+type errProfiler struct{}
+
+func (errProfiler) Goroutines() ([]*Goroutine, error) {
+	return nil, errors.New("whups")
+}